@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func runAdd(root, gopath string, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	opts := new(SyncOptions)
+	addSyncFlags(fs, opts)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("usage: glp add IMPORTPATH[@REV]...")
+	}
+	return Add(root, gopath, args, opts)
+}
+
+// Add pins the packages given by specs (each an import path, optionally followed by @ and a revision, tag, or
+// branch) before the project imports them, and then re-syncs the project.
+//   - The repo containing each package is fetched into the cache and moved to the given revision (following
+//     the tag or branch from then on, as with 'glp update --version'). A repo that is not pinned yet is moved
+//     to the latest upstream revision if no revision is given; a pinned one stays where it is. Either way,
+//     the package must exist at the revision the repo ends up at.
+//   - The package is recorded as explicit in the repo's pinlist entry, so that sync keeps it (along with its
+//     transitive deps) even though no project code imports it
+//   - The project is synced (using opts), which pins the package's transitive deps
+func Add(root, gopath string, specs []string, opts *SyncOptions) error {
+	pinlistFilename := filepath.Join(root, projectDirName, pinlistName)
+	if frozenMode {
+		return fmt.Errorf("cannot add to %s because $GLP_FROZEN is set", pinlistFilename)
+	}
+	pinlist, err := loadPinlistIfExists(root)
+	if err != nil {
+		return err
+	}
+	cacheDir := config.cacheSrcDir(root)
+	for _, spec := range specs {
+		importPath, rev := spec, ""
+		if i := strings.LastIndex(spec, "@"); i >= 0 {
+			importPath, rev = spec[:i], spec[i+1:]
+			if rev == "" {
+				return fmt.Errorf("bad package %q (empty revision after @)", spec)
+			}
+		}
+		if importPath == "" || strings.HasPrefix(importPath, ".") || filepath.IsAbs(importPath) {
+			return fmt.Errorf("bad package %q (must be an import path)", spec)
+		}
+		if err := addPackage(pinlist, cacheDir, importPath, rev); err != nil {
+			return err
+		}
+	}
+
+	if err := pinlist.Save(pinlistFilename); err != nil {
+		return err
+	}
+	return Sync(root, gopath, opts)
+}
+
+// addPackage adds importPath to pinlist as an explicit package, fetching its repo into cacheDir and moving
+// it to rev (see Add).
+func addPackage(pinlist *Pinlist, cacheDir, importPath, rev string) error {
+	pinned := pinlist.FindPackage(importPath)
+	if pinned == nil {
+		repo, err := lookupRepoRoot(importPath, cacheDir)
+		if err != nil {
+			return err
+		}
+		pinlist.Repos = append(pinlist.Repos, PinnedRepo{Root: repo.Root, URL: repo.Repo, VCS: repo.VCS.Cmd.Cmd})
+		pinned = &pinlist.Repos[len(pinlist.Repos)-1]
+	}
+	repo := pinned.RepoRoot()
+	dir := filepath.Join(cacheDir, pinned.Root)
+
+	newRev, newVersion := pinned.Rev, pinned.Version
+	explicit := smap(pinned.Explicit)
+	checkRev := "" // the rev at which to check that the package exists, if it needs checking
+	var err error
+	switch {
+	case rev != "":
+		// A tag or branch is followed from now on; anything else is taken to be a revision. In offline mode,
+		// only cached tags and branches are found, and any other rev must be cached.
+		if err = cacheRepo(repo, dir); err != nil {
+			break
+		}
+		var versionErr error
+		newRev, _, versionErr = repo.VCS.ResolveVersion(dir, rev)
+		newVersion = rev
+		if versionErr != nil {
+			newRev, newVersion = rev, ""
+		}
+		newRev, err = updateRepo(repo, dir, newRev)
+		checkRev = newRev
+	case pinned.Rev == "" && pinned.Version == "":
+		newRev, err = updateRepo(repo, dir, "")
+		checkRev = newRev
+	case !explicit.Contains(importPath):
+		// The repo stays where it is, but the package still needs to exist there.
+		checkRev = pinned.Rev
+		if err = cacheRepo(repo, dir); err == nil && checkRev == "" {
+			checkRev, _, err = repo.VCS.ResolveVersion(dir, pinned.Version)
+		}
+		if err == nil {
+			checkRev, err = updateRepo(repo, dir, checkRev)
+		}
+	}
+	if err != nil {
+		if err == errOffline {
+			return fmt.Errorf("cannot add %s: %s", importPath, err)
+		}
+		return err
+	}
+	if checkRev != "" {
+		if _, err := os.Stat(filepath.Join(cacheDir, importPath)); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("package %s does not exist in dep repo %s at rev %s", importPath, pinned.Root,
+					checkRev)
+			}
+			return err
+		}
+	}
+	if pinned.Version != "" && newVersion == "" {
+		textf("Dep repo %s no longer follows version %s\n", pinned.Root, pinned.Version)
+	}
+	if newRev != pinned.Rev {
+		pinned.Hash = "" // sync records the hash of the new rev
+	}
+	pinned.Rev = newRev
+	pinned.Version = newVersion
+	explicit.Add(importPath)
+	pinned.Explicit = explicit
+	logEvent("package-added", eventFields{"package": importPath, "repo": pinned.Root, "rev": pinned.Rev},
+		"Added package %s (dep repo %s at rev %s)\n", importPath, pinned.Root, pinned.Rev)
+	return nil
+}
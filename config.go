@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const configName = "config.json"
+
+// A Config holds the project-level settings in glp/config.json. The file is optional, and so is every field;
+// the zero Config gives glp's default behavior.
+type Config struct {
+	// SourceDirs lists directories (relative to the project root) containing more project packages, in
+	// addition to the root directory and src/. They are searched recursively. Their packages can't be imported
+	// (they are outside of the GOPATH), so they are named by relative path, like "./cmd/foo".
+	SourceDirs []string `json:"source_dirs"`
+	// IgnoreDirs lists the names of directories that glp skips when looking for packages, in the project and
+	// in the cache.
+	IgnoreDirs []string `json:"ignore_dirs"`
+	// DisabledCommands lists go commands that can't be run through glp, in addition to the ones that are
+	// disabled by default (see disabledGoCommands). AllowedCommands re-enables commands that are disabled by
+	// default.
+	DisabledCommands []string `json:"disabled_commands"`
+	AllowedCommands  []string `json:"allowed_commands"`
+	// Exclude lists project packages that glp ignores, so that their imports are not pinned. Each is a package
+	// name (see findProjectPackages), a glob, or a pattern in which "..." matches any string, as with the go
+	// tool (for example, "foo/experimental/..." or "./cmd/...").
+	Exclude []string `json:"exclude"`
+	// CacheDir is the location of the cache, either absolute or relative to the project root (by default,
+	// glp/_cache). It must be apart from the project's own files (see validate).
+	CacheDir string `json:"cache_dir"`
+	// Platforms and Tags are the defaults for the -platforms and -tags flags (see BuildOptions).
+	Platforms []string `json:"platforms"`
+	Tags      []string `json:"tags"`
+	// Flags maps a command (a glp command or a go command run through glp) to the flags that are passed to it
+	// before any given on the command line.
+	Flags map[string][]string `json:"flags"`
+}
+
+// config is the configuration of the current project, which is loaded at startup.
+var config = new(Config)
+
+// loadConfig reads the configuration of the project located at root. If there is no config file, the
+// default (empty) configuration is returned.
+func loadConfig(root string) (*Config, error) {
+	filename := filepath.Join(root, projectDirName, configName)
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return new(Config), nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	c := new(Config)
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return nil, fmt.Errorf("Error loading config %s: %s", filename, err)
+	}
+	if err := c.validate(root); err != nil {
+		return nil, fmt.Errorf("Error loading config %s: %s", filename, err)
+	}
+	return c, nil
+}
+
+// validate checks the configuration of the project located at root.
+func (c *Config) validate(root string) error {
+	for _, dir := range c.SourceDirs {
+		if dir == "" || filepath.IsAbs(dir) || strings.HasPrefix(filepath.Clean(dir), "..") {
+			return fmt.Errorf("bad source dir %q (must be a directory inside the project)", dir)
+		}
+	}
+	for _, name := range c.IgnoreDirs {
+		if name == "" || strings.ContainsRune(name, '/') {
+			return fmt.Errorf("bad ignored dir %q (must be a directory name)", name)
+		}
+	}
+	for _, pattern := range c.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad exclude pattern %q: %s", pattern, err)
+		}
+	}
+	for _, p := range c.Platforms {
+		if _, err := parsePlatform(p); err != nil {
+			return err
+		}
+	}
+
+	// Sync and prune remove anything in the cache that they don't expect, so the cache mustn't overlap with
+	// the project's packages or glp/ (apart from the default cache directory).
+	if c.CacheDir != "" {
+		cache := c.cacheDir(root)
+		if dirContains(cache, root) {
+			return fmt.Errorf("bad cache dir %q (must not contain the project)", c.CacheDir)
+		}
+		defaultCache := filepath.Join(root, projectDirName, cacheDirName)
+		for _, dir := range append([]string{"src", projectDirName}, c.SourceDirs...) {
+			dir = filepath.Join(root, dir)
+			if dirContains(cache, dir) || dirContains(dir, cache) && !dirContains(defaultCache, cache) {
+				return fmt.Errorf("bad cache dir %q (must not overlap with %s)", c.CacheDir, dir)
+			}
+		}
+	}
+	return nil
+}
+
+// dirContains reports whether dir is parent or a directory inside it.
+func dirContains(parent, dir string) bool {
+	rel, err := filepath.Rel(parent, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// cacheDir returns the cache directory of the project located at root. This is the GOPATH entry; the repos
+// are in its src/ directory (see cacheSrcDir).
+func (c *Config) cacheDir(root string) string {
+	switch {
+	case c.CacheDir == "":
+		return filepath.Join(root, projectDirName, cacheDirName)
+	case filepath.IsAbs(c.CacheDir):
+		return filepath.Clean(c.CacheDir)
+	}
+	return filepath.Join(root, c.CacheDir)
+}
+
+// cacheSrcDir returns the directory containing the cached repos of the project located at root.
+func (c *Config) cacheSrcDir(root string) string {
+	return filepath.Join(c.cacheDir(root), "src")
+}
+
+// commandDisabled reports whether the go command can't be run through glp.
+func (c *Config) commandDisabled(command string) bool {
+	for _, allowed := range c.AllowedCommands {
+		if allowed == command {
+			return false
+		}
+	}
+	for _, disabled := range c.DisabledCommands {
+		if disabled == command {
+			return true
+		}
+	}
+	return disabledGoCommands[command]
+}
+
+// ignoresDir reports whether glp skips directories with the given name when looking for packages.
+func (c *Config) ignoresDir(name string) bool {
+	if ignoreDirs[name] {
+		return true
+	}
+	for _, ignored := range c.IgnoreDirs {
+		if ignored == name {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedBy returns the exclude pattern that matches the project package name, or "" if it is not excluded.
+func (c *Config) excludedBy(name string) string {
+	for _, pattern := range c.Exclude {
+		if matchPackagePattern(pattern, name) {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// matchPackagePattern reports whether the package name matches pattern, which is either a glob (see
+// path.Match) or, like the go tool's package patterns, a path in which "..." matches any string (so that
+// "foo/..." matches foo and every package beneath it).
+func matchPackagePattern(pattern, name string) bool {
+	if !strings.Contains(pattern, "...") {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}
+	re := strings.Replace(regexp.QuoteMeta(pattern), `\.\.\.`, `.*`, -1)
+	if strings.HasSuffix(re, `/.*`) {
+		re = strings.TrimSuffix(re, `/.*`) + `(/.*)?`
+	}
+	return regexp.MustCompile("^" + re + "$").MatchString(name)
+}
+
+// buildOptions returns the default BuildOptions.
+func (c *Config) buildOptions() *BuildOptions {
+	return &BuildOptions{Platforms: c.Platforms, Tags: c.Tags}
+}
+
+// withFlags returns args (a command and its arguments) with the configured flags for the command inserted
+// after the command.
+func (c *Config) withFlags(args []string) []string {
+	flags := c.Flags[args[0]]
+	if len(flags) == 0 {
+		return args
+	}
+	result := append([]string{args[0]}, flags...)
+	return append(result, args[1:]...)
+}
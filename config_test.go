@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchPackagePattern(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"foo/bar", "foo/bar", true},
+		{"foo/bar", "foo/baz", false},
+		{"foo/bar", "foo/bar/baz", false},
+
+		// Globs
+		{"foo/*", "foo/bar", true},
+		{"foo/*", "foo", false},
+		{"foo/*", "foo/bar/baz", false},
+		{"foo/ba?", "foo/baz", true},
+		{"foo/[", "foo/[", false}, // bad pattern
+
+		// ... patterns
+		{"foo/...", "foo", true},
+		{"foo/...", "foo/bar", true},
+		{"foo/...", "foo/bar/baz", true},
+		{"foo/...", "foobar", false},
+		{"foo...", "foobar", true},
+		{"foo...", "foo/bar", true},
+		{"foo/.../bar", "foo/x/y/bar", true},
+		{"foo/.../bar", "foo/x/bar/baz", false},
+		{".../internal/...", "a/internal", true},
+		{".../internal/...", "a/b/internal/c", true},
+		{".../internal/...", "a/internals", false},
+		{"a.b/...", "axb/c", false}, // the rest of the pattern is literal
+		{"a.b/*/...", "a.b/*/c", true},
+		{"a.b/*/...", "a.b/x/c", false},
+	} {
+		if got := matchPackagePattern(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchPackagePattern(%q, %q): got %t; want %t", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateCacheDir(t *testing.T) {
+	root := filepath.FromSlash("/home/me/project")
+	for _, tt := range []struct {
+		cacheDir string
+		ok       bool
+	}{
+		{"", true},
+		{"_cache", true},
+		{"../glp-cache", true},
+		{"glp/_cache", true},
+		{"glp/_cache/more", true},
+		{filepath.FromSlash("/var/cache/glp"), true},
+		{"cmd2", true},
+		{".", false},
+		{"..", false},
+		{"../..", false},
+		{root, false},
+		{"src", false},
+		{"src/cache", false},
+		{"glp", false},
+		{"glp/cache", false},
+		{"cmd", false},
+		{"cmd/foo/cache", false},
+		{filepath.FromSlash("/home/me/project/src"), false},
+		{filepath.FromSlash("/home"), false},
+	} {
+		c := &Config{SourceDirs: []string{"cmd"}, CacheDir: tt.cacheDir}
+		if err := c.validate(root); (err == nil) != tt.ok {
+			t.Errorf("validate with cache_dir %q: got error %v; want ok=%t", tt.cacheDir, err, tt.ok)
+		}
+	}
+}
+
+func TestCacheDir(t *testing.T) {
+	root := filepath.FromSlash("/home/me/project")
+	for _, tt := range []struct {
+		cacheDir, want string
+	}{
+		{"", "/home/me/project/glp/_cache"},
+		{"../glp-cache", "/home/me/glp-cache"},
+		{"/var/cache/glp/", "/var/cache/glp"},
+	} {
+		c := &Config{CacheDir: filepath.FromSlash(tt.cacheDir)}
+		if got := c.cacheDir(root); got != filepath.FromSlash(tt.want) {
+			t.Errorf("cacheDir with cache_dir %q: got %q; want %q", tt.cacheDir, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
+)
+
+// exportModGoVersion is the go directive written by 'glp export-mod'. Go 1.16 is the last version whose
+// go.mod files needn't list every module that provides a package to the build.
+const exportModGoVersion = "1.16"
+
+// localModuleVersion is the version at which the project's main module requires its local modules (the
+// packages in src/), which are replaced by their directories.
+const localModuleVersion = "v0.0.0-00010101000000-000000000000"
+
+// An exportedModule is a pinned repo converted into a module version.
+type exportedModule struct {
+	module.Version
+	Repo PinnedRepo
+	// Dir is the location of the repo in the cache.
+	Dir string
+	// Files is a directory holding the files committed at the pinned rev, which make up the module (see
+	// VCSCmd.Export). It is only set for the pinned versions.
+	Files string
+	Time  time.Time
+	// GoMod is the repo's go.mod file, or a minimal one if the repo doesn't have one.
+	GoMod []byte
+}
+
+type exportedModules []*exportedModule
+
+func (m exportedModules) Len() int      { return len(m) }
+func (m exportedModules) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m exportedModules) Less(i, j int) bool {
+	if m[i].Path != m[j].Path {
+		return m[i].Path < m[j].Path
+	}
+	return semver.Compare(m[i].Version.Version, m[j].Version.Version) < 0
+}
+
+func runExportMod(root, gopath string, args []string) error {
+	fs := flag.NewFlagSet("export-mod", flag.ContinueOnError)
+	modulePath := fs.String("module", filepath.Base(root), "Module `path` of the project")
+	proxyDir := fs.String("proxy", "", "Also write the dependencies as a module proxy in `DIR`")
+	force := fs.Bool("force", false, "Replace an existing go.mod and go.sum")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments to export-mod: %v", args)
+	}
+	if *proxyDir != "" && !filepath.IsAbs(*proxyDir) {
+		*proxyDir = filepath.Join(root, *proxyDir)
+	}
+	return ExportMod(root, gopath, *modulePath, *proxyDir, *force)
+}
+
+// ExportMod writes a go.mod and go.sum for the project located at root, with modulePath as its module path,
+// that require its pinned dependencies at exactly their pinned revisions. Packages in the project's src/
+// directory are made into local modules (one for each top-level directory in src/), which are required by
+// the main module and replaced by their directories. If proxyDir is not empty, the dependency modules are
+// also written there in the layout of a module proxy, so that the output can be checked without network
+// access. Nothing is written until every check has passed and every hash has been computed.
+//   - Each pinned repo becomes a module whose path is the repo root. Its version is the highest semver tag
+//     on the pinned revision, if there is one, or else a pseudo-version built from the highest semver tag
+//     on an ancestor of the pinned revision and the revision's commit time
+//   - The go.mod files of the dependencies must not make the go command select any other versions (see
+//     checkRequirements)
+//   - The go.sum hashes are computed from the cached repos (which must match the pinlist) in the same way as
+//     the go command does
+func ExportMod(root, gopath, modulePath, proxyDir string, force bool) error {
+	goModFilename := filepath.Join(root, "go.mod")
+	goSumFilename := filepath.Join(root, "go.sum")
+	if !force {
+		for _, name := range []string{goModFilename, goSumFilename} {
+			if _, err := os.Stat(name); err == nil {
+				return fmt.Errorf("%s already exists (use --force to replace it)", name)
+			}
+		}
+	}
+	if err := module.CheckImportPath(modulePath); err != nil {
+		return fmt.Errorf("bad module path: %s", err)
+	}
+	pinlist, err := loadRequiredPinlist(root)
+	if err != nil {
+		return err
+	}
+	report, err := Verify(root, pinlist)
+	if err != nil {
+		return err
+	}
+	if err := report.CheckHashes(root); err != nil {
+		return err
+	}
+	if err := report.ExactErr(); err != nil {
+		return err
+	}
+	localModules, err := findLocalModules(root, gopath, modulePath)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir("", "glp-export-mod-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	cacheDir := config.cacheSrcDir(root)
+	var modules []*exportedModule
+	for i, repo := range pinlist.Repos {
+		dir := filepath.Join(cacheDir, filepath.FromSlash(repo.Root))
+		m, err := exportModule(repo, dir, filepath.Join(tmpDir, strconv.Itoa(i)))
+		if err != nil {
+			return err
+		}
+		modules = append(modules, m)
+	}
+	sort.Sort(exportedModules(modules))
+
+	// go.mod
+	f := new(modfile.File)
+	if err := f.AddModuleStmt(modulePath); err != nil {
+		return err
+	}
+	if err := f.AddGoStmt(exportModGoVersion); err != nil {
+		return err
+	}
+	for _, m := range modules {
+		f.AddNewRequire(m.Path, m.Version.Version, false)
+	}
+	localGoMods := make(map[string][]byte) // by local module path
+	var missingGoMods []string             // the local modules without a go.mod
+	for _, local := range localModules {
+		f.AddNewRequire(local, localModuleVersion, false)
+		if err := f.AddReplace(local, "", "./src/"+local, ""); err != nil {
+			return err
+		}
+		filename := filepath.Join(root, "src", filepath.FromSlash(local), "go.mod")
+		goMod, exists, err := localGoMod(filename, local)
+		if err != nil {
+			return err
+		}
+		localGoMods[local] = goMod
+		if !exists {
+			missingGoMods = append(missingGoMods, local)
+		}
+	}
+	f.Cleanup()
+	goMod, err := f.Format()
+	if err != nil {
+		return err
+	}
+	required, err := checkRequirements(modules, localModules, localGoMods)
+	if err != nil {
+		return err
+	}
+
+	// go.sum
+	sums := make(map[module.Version]string)
+	zips := make(map[*exportedModule]string)
+	for _, m := range modules {
+		zips[m] = m.Files + ".zip"
+		if sums[m.Version], err = hashModule(m, zips[m]); err != nil {
+			return err
+		}
+	}
+	for _, m := range append(modules, required...) {
+		goModHash, err := dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(m.GoMod)), nil
+		})
+		if err != nil {
+			return err
+		}
+		sums[module.Version{Path: m.Path, Version: m.Version.Version + "/go.mod"}] = goModHash
+	}
+	var sumKeys []module.Version
+	for v := range sums {
+		sumKeys = append(sumKeys, v)
+	}
+	module.Sort(sumKeys)
+	var goSum bytes.Buffer
+	for _, v := range sumKeys {
+		fmt.Fprintf(&goSum, "%s %s %s\n", v.Path, v.Version, sums[v])
+	}
+
+	// Everything has been checked, so write the files.
+	for _, local := range missingGoMods {
+		filename := filepath.Join(root, "src", filepath.FromSlash(local), "go.mod")
+		if err := ioutil.WriteFile(filename, localGoMods[local], 0644); err != nil {
+			return err
+		}
+	}
+	if proxyDir != "" {
+		for _, m := range required {
+			if _, err := writeProxyFiles(m, proxyDir); err != nil {
+				return err
+			}
+		}
+		for _, m := range modules {
+			dir, err := writeProxyFiles(m, proxyDir)
+			if err != nil {
+				return err
+			}
+			zipFilename := filepath.Join(dir, mustEscapeVersion(m.Version.Version)+".zip")
+			if err := copyFile(zips[m], zipFilename, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	if err := ioutil.WriteFile(goModFilename, goMod, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(goSumFilename, goSum.Bytes(), 0644); err != nil {
+		return err
+	}
+	for _, m := range modules {
+		logEvent("module-exported",
+			eventFields{"repo": m.Repo.Root, "rev": m.Repo.Rev, "version": m.Version.Version},
+			"%s: rev %s -> %s\n", m.Path, m.Repo.Rev, m.Version.Version)
+	}
+	logEvent("mod-exported",
+		eventFields{"module": modulePath, "modules": len(modules), "local_modules": localModules},
+		"Wrote %s and %s for module %s.\n", goModFilename, goSumFilename, modulePath)
+	if proxyDir != "" {
+		logEvent("proxy-written", eventFields{"dir": proxyDir},
+			"Wrote the dependency modules to %s. To build using only them, run\n"+
+				"\tGOFLAGS=-mod=mod GOPROXY=file://%s GOSUMDB=off go build ./...\n", proxyDir, proxyDir)
+	}
+	return nil
+}
+
+// findLocalModules returns the module paths of the local modules of the project located at root: the
+// deepest common directory of the packages in each top-level directory of src/.
+func findLocalModules(root, gopath, modulePath string) ([]string, error) {
+	matrix, err := newBuildMatrix(gopath, config.buildOptions())
+	if err != nil {
+		return nil, err
+	}
+	packages, _, err := findProjectPackages(matrix, root)
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]string)
+	for name := range packages {
+		if !isLocalPackage(name) {
+			top := strings.SplitN(name, "/", 2)[0]
+			groups[top] = append(groups[top], name)
+		}
+	}
+	var localModules smap
+	for _, group := range groups {
+		local := commonImportPath(group)
+		if hasPathPrefix(modulePath, local) || hasPathPrefix(local, modulePath) {
+			return nil, fmt.Errorf("module path %s overlaps with the project packages in src/%s; "+
+				"choose another with -module", modulePath, local)
+		}
+		localModules.Add(local)
+	}
+	return localModules, nil
+}
+
+// localGoMod reads the go.mod file (at filename) of the local module with the given path, and checks that it
+// is for that module. If there is no go.mod, it returns a minimal one instead, and exists is false.
+func localGoMod(filename, local string) (goMod []byte, exists bool, err error) {
+	goMod, err = ioutil.ReadFile(filename)
+	switch {
+	case err == nil:
+		if path := modfile.ModulePath(goMod); path != local {
+			return nil, false, fmt.Errorf("%s is for module %q, but its packages are imported as %s", filename,
+				path, local)
+		}
+		return goMod, true, nil
+	case !os.IsNotExist(err):
+		return nil, false, err
+	}
+	f := new(modfile.File)
+	if err := f.AddModuleStmt(local); err != nil {
+		return nil, false, err
+	}
+	if err := f.AddGoStmt(exportModGoVersion); err != nil {
+		return nil, false, err
+	}
+	goMod, err = f.Format()
+	return goMod, false, err
+}
+
+// checkRequirements checks that the go command, starting from a main module that requires exactly modules
+// and the local modules (whose go.mod files are given by localGoMods), selects every module at its pinned
+// version. Minimal version selection walks the requirements of the dependencies' own go.mod files as well,
+// and picks the highest version required of each module, so it is an error for any of them to require a
+// module that isn't pinned or to require a higher version than the pinned one.
+//
+// The go command also reads the go.mod files of the lower versions required along the way (and checks them
+// against go.sum). checkRequirements reads them from the cached repos, and returns those versions.
+func checkRequirements(modules []*exportedModule, localModules []string,
+	localGoMods map[string][]byte) ([]*exportedModule, error) {
+
+	pinned := make(map[string]*exportedModule)
+	for _, m := range modules {
+		pinned[m.Path] = m
+	}
+	type requirement struct {
+		module.Version
+		By string
+	}
+	var queue []requirement
+	addRequires := func(by string, goMod []byte) error {
+		f, err := modfile.ParseLax(by+"/go.mod", goMod, nil)
+		if err != nil {
+			return err
+		}
+		for _, r := range f.Require {
+			queue = append(queue, requirement{r.Mod, by})
+		}
+		return nil
+	}
+	for _, m := range modules {
+		if err := addRequires(m.Path+"@"+m.Version.Version, m.GoMod); err != nil {
+			return nil, err
+		}
+	}
+	for _, local := range localModules {
+		if err := addRequires(local, localGoMods[local]); err != nil {
+			return nil, err
+		}
+	}
+
+	locals := smap(localModules)
+	var required []*exportedModule
+	seen := make(map[module.Version]bool)
+	for len(queue) > 0 {
+		r := queue[0]
+		queue = queue[1:]
+		if seen[r.Version] || locals.Contains(r.Path) {
+			continue
+		}
+		seen[r.Version] = true
+		m := pinned[r.Path]
+		switch {
+		case m == nil:
+			return nil, fmt.Errorf("%s requires module %s, which is not pinned (pin the repo that provides it, "+
+				"for example with 'glp add')", r.By, r.Path)
+		case r.Version.Version == m.Version.Version:
+		case semver.Compare(r.Version.Version, m.Version.Version) > 0:
+			return nil, fmt.Errorf("%s requires %s %s, but dep repo %s is pinned at rev %s (%s), and the go "+
+				"command would select the higher version; update dep repo %s to that version or later",
+				r.By, r.Path, r.Version.Version, m.Repo.Root, m.Repo.Rev, m.Version.Version, m.Repo.Root)
+		default:
+			lower, err := exportRequiredVersion(m, r.Version.Version)
+			if err != nil {
+				return nil, fmt.Errorf("%s requires %s %s: %s", r.By, r.Path, r.Version.Version, err)
+			}
+			required = append(required, lower)
+			if err := addRequires(lower.Path+"@"+lower.Version.Version, lower.GoMod); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Sort(exportedModules(required))
+	return required, nil
+}
+
+// exportRequiredVersion returns the module version of m at the given (lower) version, read from the cached
+// repo. Only its go.mod file and commit time are filled in.
+func exportRequiredVersion(m *exportedModule, version string) (*exportedModule, error) {
+	rev := pseudoVersionRev(version)
+	if rev == "" {
+		rev = strings.TrimSuffix(version, "+incompatible") // a tag
+	}
+	v := m.Repo.RepoRoot().VCS
+	goMod, err := v.FileAt(m.Dir, rev, "go.mod")
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		goMod = minimalGoMod(m.Path)
+	default:
+		return nil, fmt.Errorf("cannot find rev %s in the cached dep repo %s: %s", rev, m.Repo.Root, err)
+	}
+	t, err := v.CommitTime(m.Dir, rev)
+	if err != nil {
+		return nil, err
+	}
+	required := &exportedModule{Repo: m.Repo, Dir: m.Dir, Time: t, GoMod: goMod}
+	required.Version = module.Version{Path: m.Path, Version: version}
+	return required, nil
+}
+
+// exportModule converts the pinned repo, which is cached in dir at its pinned rev, into a module version. The
+// committed files are exported into the new directory files.
+func exportModule(repo PinnedRepo, dir, files string) (*exportedModule, error) {
+	v := repo.RepoRoot().VCS
+	if err := v.Export(dir, repo.Rev, files); err != nil {
+		return nil, fmt.Errorf("cannot export rev %s of dep repo %s: %s", repo.Rev, repo.Root, err)
+	}
+	m := &exportedModule{Repo: repo, Dir: dir, Files: files}
+	m.Path = repo.Root
+	hasGoMod := false
+	goMod, err := ioutil.ReadFile(filepath.Join(files, "go.mod"))
+	switch {
+	case err == nil:
+		hasGoMod = true
+		if path := modfile.ModulePath(goMod); path != repo.Root {
+			return nil, fmt.Errorf("repo %s has a go.mod for module %q; only repos whose module path is the "+
+				"repo root can be exported", repo.Root, path)
+		}
+		m.GoMod = goMod
+	case os.IsNotExist(err):
+		m.GoMod = minimalGoMod(repo.Root)
+	default:
+		return nil, err
+	}
+	if err := module.CheckPath(m.Path); err != nil {
+		return nil, fmt.Errorf("repo %s cannot be a module: %s", repo.Root, err)
+	}
+	_, pathMajor, _ := module.SplitPathVersion(m.Path)
+
+	m.Time, err = v.CommitTime(dir, repo.Rev)
+	if err != nil {
+		return nil, err
+	}
+	exact, all, err := v.Tags(dir, repo.Rev)
+	if err != nil {
+		return nil, err
+	}
+	if tag := highestTag(exact, pathMajor, hasGoMod); tag != "" {
+		m.Version.Version = tag
+	} else {
+		m.Version.Version = pseudoVersion(pathMajor, highestTag(all, pathMajor, hasGoMod), m.Time, repo.Rev)
+	}
+	return m, nil
+}
+
+// minimalGoMod returns the go.mod file that the go command assumes for a module with the given path that
+// doesn't have one.
+func minimalGoMod(path string) []byte {
+	return []byte(fmt.Sprintf("module %s\n", modfile.AutoQuote(path)))
+}
+
+// highestTag returns the highest of tags that is a canonical semantic version allowed for a module whose path
+// has the major version suffix pathMajor, or "" if there is none. Tags for major version 2 and above are
+// allowed (as +incompatible versions) for modules without a go.mod file and without a major version suffix.
+func highestTag(tags []string, pathMajor string, hasGoMod bool) string {
+	best := ""
+	for _, tag := range tags {
+		if semver.Canonical(tag) != tag {
+			continue
+		}
+		v := tag
+		if module.CheckPathMajor(v, pathMajor) != nil {
+			if pathMajor != "" || hasGoMod {
+				continue
+			}
+			v += "+incompatible"
+			if module.CheckPathMajor(v, pathMajor) != nil {
+				continue
+			}
+		}
+		if best == "" || semver.Compare(v, best) > 0 {
+			best = v
+		}
+	}
+	return best
+}
+
+// pseudoVersion returns the pseudo-version for rev, committed at t, whose nearest tagged ancestor is base (or
+// which has no tagged ancestor, if base is ""). See https://golang.org/ref/mod#pseudo-versions.
+func pseudoVersion(pathMajor, base string, t time.Time, rev string) string {
+	suffix := t.UTC().Format("20060102150405") + "-" + shortRev(rev)
+	build := semver.Build(base)
+	base = strings.TrimSuffix(base, build)
+	switch {
+	case base == "":
+		major := module.PathMajorPrefix(pathMajor)
+		if major == "" {
+			major = "v0"
+		}
+		return major + ".0.0-" + suffix
+	case semver.Prerelease(base) != "":
+		return base + ".0." + suffix + build
+	}
+	// Increment the patch version: vX.Y.Z -> vX.Y.(Z+1)-0.
+	i := strings.LastIndex(base, ".")
+	patch, _ := strconv.Atoi(base[i+1:])
+	return fmt.Sprintf("%s.%d-0.%s%s", base[:i], patch+1, suffix, build)
+}
+
+// pseudoVersionRE matches pseudo-versions (of any of the forms built by pseudoVersion).
+var pseudoVersionRE = regexp.MustCompile(`^v[0-9]+\.(0\.0-|\d+\.\d+-([^+]*\.)?0\.)\d{14}-[A-Za-z0-9]+` +
+	`(\+[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+
+// pseudoVersionRev returns the abbreviated rev in v if v is a pseudo-version, or else "".
+func pseudoVersionRev(v string) string {
+	if !pseudoVersionRE.MatchString(v) {
+		return ""
+	}
+	v = strings.TrimSuffix(v, semver.Build(v))
+	return v[strings.LastIndex(v, "-")+1:]
+}
+
+// shortRev abbreviates rev the way the go command does in pseudo-versions.
+func shortRev(rev string) string {
+	if len(rev) > 12 {
+		return rev[:12]
+	}
+	return rev
+}
+
+// hashModule writes the zip file for m (made from m.Files, as the go command makes it from the VCS) to
+// zipFilename and returns its go.sum hash.
+func hashModule(m *exportedModule, zipFilename string) (string, error) {
+	zipFile, err := os.Create(zipFilename)
+	if err != nil {
+		return "", err
+	}
+	if err := modzip.CreateFromDir(zipFile, m.Version, m.Files); err != nil {
+		zipFile.Close()
+		return "", fmt.Errorf("cannot create module zip for %s: %s", m.Repo.Root, err)
+	}
+	if err := zipFile.Close(); err != nil {
+		return "", err
+	}
+	return dirhash.HashZip(zipFilename, dirhash.Hash1)
+}
+
+// writeProxyFiles writes the list, .info, and .mod files for m into the module proxy in proxyDir. It returns
+// the directory (proxyDir/<module>/@v) in which they were written.
+func writeProxyFiles(m *exportedModule, proxyDir string) (string, error) {
+	escapedPath, err := module.EscapePath(m.Path)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(proxyDir, filepath.FromSlash(escapedPath), "@v")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	listFilename := filepath.Join(dir, "list")
+	list, err := ioutil.ReadFile(listFilename)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	versions := smap(strings.Fields(string(list)))
+	versions.Add(m.Version.Version)
+	if err := ioutil.WriteFile(listFilename, []byte(strings.Join(versions, "\n")+"\n"), 0644); err != nil {
+		return "", err
+	}
+
+	info, err := json.Marshal(struct {
+		Version string
+		Time    time.Time
+	}{m.Version.Version, m.Time})
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Join(dir, mustEscapeVersion(m.Version.Version))
+	if err := ioutil.WriteFile(base+".info", info, 0644); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(base+".mod", m.GoMod, 0644); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// mustEscapeVersion escapes v (which must be a valid version) for use in a module proxy path.
+func mustEscapeVersion(v string) string {
+	escaped, err := module.EscapeVersion(v)
+	if err != nil {
+		panic(err)
+	}
+	return escaped
+}
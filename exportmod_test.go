@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHighestTag(t *testing.T) {
+	for _, tt := range []struct {
+		tags      []string
+		pathMajor string
+		hasGoMod  bool
+		want      string
+	}{
+		{nil, "", false, ""},
+		{[]string{"junk", "1.5.0", "v1.3"}, "", false, ""},
+		{[]string{"v1.0.0", "v1.10.0", "v1.2.0", "junk", "1.50.0", "v1.30"}, "", false, "v1.10.0"},
+		{[]string{"v0.1.0", "v0.9.0"}, "", true, "v0.9.0"},
+		{[]string{"v1.0.0", "v1.1.0-rc.1"}, "", true, "v1.1.0-rc.1"},
+		// Major versions 2 and above need a suffix, unless the repo has no go.mod.
+		{[]string{"v1.0.0", "v2.0.0", "v3.1.0"}, "", false, "v3.1.0+incompatible"},
+		{[]string{"v1.0.0", "v2.0.0", "v3.1.0"}, "", true, "v1.0.0"},
+		{[]string{"v2.0.0+incompatible"}, "", false, ""},
+		{[]string{"v1.0.0", "v2.1.0", "v3.0.0"}, "/v2", false, "v2.1.0"},
+		{[]string{"v1.0.0", "v2.1.0", "v3.0.0"}, "/v2", true, "v2.1.0"},
+		{[]string{"v1.0.0", "v2.1.0"}, ".v2", false, "v2.1.0"},
+		{[]string{"v1.0.0"}, "/v2", false, ""},
+	} {
+		if got := highestTag(tt.tags, tt.pathMajor, tt.hasGoMod); got != tt.want {
+			t.Errorf("highestTag(%q, %q, %t): got %q; want %q", tt.tags, tt.pathMajor, tt.hasGoMod, got, tt.want)
+		}
+	}
+}
+
+func TestPseudoVersion(t *testing.T) {
+	tm := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("", -8*60*60))
+	rev := "abcdef0123456789abcdef0123456789abcdef01"
+	for _, tt := range []struct {
+		pathMajor string
+		base      string
+		rev       string
+		want      string
+	}{
+		{"", "", rev, "v0.0.0-20200102110405-abcdef012345"},
+		{"/v2", "", rev, "v2.0.0-20200102110405-abcdef012345"},
+		{".v3", "", rev, "v3.0.0-20200102110405-abcdef012345"},
+		{"", "v1.2.3", rev, "v1.2.4-0.20200102110405-abcdef012345"},
+		{"", "v1.2.9", rev, "v1.2.10-0.20200102110405-abcdef012345"},
+		{"", "v1.2.3-pre", rev, "v1.2.3-pre.0.20200102110405-abcdef012345"},
+		{"", "v2.0.0+incompatible", rev, "v2.0.1-0.20200102110405-abcdef012345+incompatible"},
+		{"", "v1.0.0", "abc123", "v1.0.1-0.20200102110405-abc123"},
+	} {
+		got := pseudoVersion(tt.pathMajor, tt.base, tm, tt.rev)
+		if got != tt.want {
+			t.Errorf("pseudoVersion(%q, %q, %s, %q): got %q; want %q", tt.pathMajor, tt.base, tm, tt.rev, got,
+				tt.want)
+		}
+		if rev := pseudoVersionRev(got); rev != shortRev(tt.rev) {
+			t.Errorf("pseudoVersionRev(%q): got %q; want %q", got, rev, shortRev(tt.rev))
+		}
+	}
+}
+
+func TestPseudoVersionRev(t *testing.T) {
+	for _, tt := range []struct {
+		v, want string
+	}{
+		{"v1.2.3", ""},
+		{"v1.2.3-pre", ""},
+		{"v2.0.0+incompatible", ""},
+		{"v1.2.3-20200102110405-abcdef012345", ""}, // not a pseudo-version: no .0 before the time
+		{"v0.0.0-20200102110405-abcdef012345", "abcdef012345"},
+		{"v1.2.4-0.20200102110405-abcdef012345+incompatible", "abcdef012345"},
+	} {
+		if got := pseudoVersionRev(tt.v); got != tt.want {
+			t.Errorf("pseudoVersionRev(%q): got %q; want %q", tt.v, got, tt.want)
+		}
+	}
+}
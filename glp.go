@@ -15,11 +15,14 @@ const (
 	projectDirName = "glp"
 	cacheDirName   = "_cache"
 	pinlistName    = "deps.json"
+	manifestName   = "deps.sum"
 )
 
 var (
-	goBinary  = ""
-	debugMode = os.Getenv("GLP_DEBUG") != ""
+	goBinary    = ""
+	debugMode   = os.Getenv("GLP_DEBUG") != ""
+	offlineMode = os.Getenv("GLP_OFFLINE") != ""
+	frozenMode  = os.Getenv("GLP_FROZEN") != ""
 )
 
 func init() {
@@ -49,9 +52,13 @@ func findProjectRoot() (string, error) {
 	}
 }
 
-// makeGOPATH constructs a $GOPATH from an absolute project root directory.
+// makeGOPATH constructs a $GOPATH from an absolute project root directory. If any dependency repos are
+// linked (see link.go), the links directory comes before the cache.
 func makeGOPATH(root string) string {
-	cacheDir := filepath.Join(root, projectDirName, cacheDirName)
+	cacheDir := config.cacheDir(root)
+	if _, err := os.Stat(linksDir(root)); err == nil {
+		return fmt.Sprintf("%s:%s:%s", root, linksDir(root), cacheDir)
+	}
 	return fmt.Sprintf("%s:%s", root, cacheDir)
 }
 
@@ -71,13 +78,30 @@ func execGoTool(args []string, env []string) error {
 	return syscall.Exec(goBinary, args, env)
 }
 
+// disabledGoCommands lists the go commands that can't be run through glp by default (see Config).
 var disabledGoCommands = map[string]bool{
 	"install": true,
 	"get":     true,
 }
 
+// parseGlobalFlags handles any glp flags that precede the command and returns the remaining arguments.
+func parseGlobalFlags(args []string) []string {
+	for len(args) > 0 {
+		switch args[0] {
+		case "--offline", "-offline":
+			offlineMode = true
+		case "--json", "-json":
+			jsonMode = true
+		default:
+			return args
+		}
+		args = args[1:]
+	}
+	return args
+}
+
 func main() {
-	args := os.Args[1:]
+	args := parseGlobalFlags(os.Args[1:])
 
 	root, err := findProjectRoot()
 	if err != nil {
@@ -90,25 +114,89 @@ func main() {
 	if err := os.Chdir(root); err != nil {
 		fatal(err)
 	}
+	if config, err = loadConfig(root); err != nil {
+		fatal(err)
+	}
 
 	gopath := makeGOPATH(root)
 
 	if len(args) > 0 {
+		args = config.withFlags(args)
 		command := args[0]
 		switch command {
+		case "add":
+			if err := runAdd(root, gopath, args[1:]); err != nil {
+				fatal(err)
+			}
+			return
+		case "export-mod":
+			if err := runExportMod(root, gopath, args[1:]); err != nil {
+				fatal(err)
+			}
+			return
+		case "graph":
+			if err := runGraph(root, gopath, args[1:]); err != nil {
+				fatal(err)
+			}
+			return
 		case "help", "-h", "--help":
 			fmt.Printf(glpHelp, os.Args[0])
 			return
+		case "import":
+			if err := runImport(root, gopath, args[1:]); err != nil {
+				fatal(err)
+			}
+			return
+		case "link":
+			if err := runLink(root, args[1:]); err != nil {
+				fatal(err)
+			}
+			return
 		case "path":
-			fmt.Println(gopath)
+			logEvent("gopath", eventFields{"gopath": gopath}, "%s\n", gopath)
+			return
+		case "status":
+			if err := Status(root, gopath); err != nil {
+				fatal(err)
+			}
 			return
 		case "sync":
-			if err := Sync(root, gopath); err != nil {
+			if err := runSync(root, gopath, args[1:]); err != nil {
+				fatal(err)
+			}
+			return
+		case "prune":
+			if err := runPrune(root, args[1:]); err != nil {
+				fatal(err)
+			}
+			return
+		case "unlink":
+			if err := runUnlink(root, args[1:]); err != nil {
+				fatal(err)
+			}
+			return
+		case "verify":
+			if err := runVerify(root, args[1:]); err != nil {
+				fatal(err)
+			}
+			return
+		case "vendor":
+			if err := runVendor(root, gopath, args[1:]); err != nil {
+				fatal(err)
+			}
+			return
+		case "why":
+			if err := runWhy(root, gopath, args[1:]); err != nil {
+				fatal(err)
+			}
+			return
+		case "update":
+			if err := runUpdate(root, gopath, args[1:]); err != nil {
 				fatal(err)
 			}
 			return
 		default:
-			if disabledGoCommands[command] {
+			if config.commandDisabled(command) {
 				fatalf("Error: the command 'go %s' cannot be used in a glp project.\n", command)
 			}
 		}
@@ -119,18 +207,33 @@ func main() {
 	pinlist, err := LoadPinlist(pinlistFilename)
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Printf("No pinlist file (looked for %s). Try running 'glp sync'.\n", pinlistFilename)
+			logEvent("no-pinlist", eventFields{"pinlist": pinlistFilename},
+				"No pinlist file (looked for %s). Try running 'glp sync'.\n", pinlistFilename)
 			os.Exit(0)
 		}
 		fatal(err)
 	}
 
-	if err := Verify(root, pinlist); err != nil {
+	report, err := Verify(root, pinlist)
+	if err != nil {
+		fatal(err)
+	}
+	report.Log()
+	if err := report.Err(); err != nil {
 		fatal(err)
 	}
 
-	// Write out the pinlist so it's normalized in case it has been hand-edited.
-	if err := pinlist.Save(pinlistFilename); err != nil {
+	// Write out the pinlist so it's normalized in case it has been hand-edited. In frozen mode, the pinlist must
+	// already be normalized instead.
+	if frozenMode {
+		saved, err := pinlist.IsSavedAs(pinlistFilename)
+		if err != nil {
+			fatal(err)
+		}
+		if !saved {
+			fatalf("Error: %s is not in normalized form (run 'glp sync' to rewrite it).\n", pinlistFilename)
+		}
+	} else if err := pinlist.Save(pinlistFilename); err != nil {
 		fatal(err)
 	}
 
@@ -140,7 +243,8 @@ func main() {
 }
 
 func fatal(args ...interface{}) {
-	fmt.Println(args...)
+	msg := fmt.Sprintln(args...)
+	logEvent("error", eventFields{"message": strings.TrimSpace(msg)}, "%s", msg)
 	if debugMode {
 		printStack()
 	}
@@ -148,7 +252,8 @@ func fatal(args ...interface{}) {
 }
 
 func fatalf(format string, args ...interface{}) {
-	fmt.Printf(format, args...)
+	msg := fmt.Sprintf(format, args...)
+	logEvent("error", eventFields{"message": strings.TrimSpace(msg)}, "%s", msg)
 	if debugMode {
 		printStack()
 	}
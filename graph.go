@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An importKind says how one package imports another.
+type importKind int
+
+const (
+	normalImport importKind = iota // from the package's own (non-test) files
+	testImport                     // from the package's in-package _test.go files
+	xtestImport                    // from the package's external (package foo_test) test files
+)
+
+func (k importKind) String() string {
+	switch k {
+	case normalImport:
+		return "normal"
+	case testImport:
+		return "test"
+	case xtestImport:
+		return "xtest"
+	}
+	return fmt.Sprintf("importKind(%d)", int(k))
+}
+
+// A packageImport is an import of the package Path by some other package.
+type packageImport struct {
+	Path string
+	Kind importKind
+	// Platforms is the set of platforms on which the import is made (see buildMatrix).
+	Platforms platformSet
+}
+
+// An importGraph is the package-level import graph of a project and its transitive dependencies. Only
+// non-stdlib packages are included.
+type importGraph struct {
+	// ProjectPackages lists the packages in the project itself, by package name (see findProjectPackages).
+	ProjectPackages smap
+	// Packages lists every package in the graph: the project packages and all of their dependencies.
+	Packages smap
+	// Imports has the imports of each package, sorted by import path.
+	Imports map[string][]packageImport
+}
+
+// buildImportGraph constructs the import graph for the project located at root from the project code and the
+// dependency packages in the cache. Dependencies are found in the same way as by Sync (so the cache should be
+// synced first): the test imports of dependencies are only included if withDepTests is true.
+func buildImportGraph(matrix *buildMatrix, root string, withDepTests bool) (*importGraph, error) {
+	g := &importGraph{Imports: make(map[string][]packageImport)}
+	packages, _, err := findProjectPackages(matrix, root)
+	if err != nil {
+		return nil, err
+	}
+	for name := range packages {
+		g.ProjectPackages.Add(name)
+		g.Packages.Add(name)
+	}
+	var toProcess smap
+	for name, imports := range packages {
+		g.addImports(name, imports, &toProcess)
+	}
+
+	cacheDir := config.cacheSrcDir(root)
+	for len(toProcess) > 0 {
+		importPath := toProcess[0]
+		toProcess.Remove(importPath)
+		imports, err := findDeps(matrix, filepath.Join(cacheDir, importPath), withDepTests)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load dependency %s from the cache (try 'glp sync'): %s", importPath, err)
+		}
+		g.Packages.Add(importPath)
+		g.addImports(importPath, imports, &toProcess)
+	}
+	return g, nil
+}
+
+// addImports records imports as the imports of the package from, and adds any packages not yet seen to
+// toProcess.
+func (g *importGraph) addImports(from string, imports []packageImport, toProcess *smap) {
+	for _, imp := range imports {
+		if imp.Path == from {
+			// External tests import the package itself.
+			continue
+		}
+		g.Imports[from] = append(g.Imports[from], imp)
+		if !g.Packages.Contains(imp.Path) {
+			toProcess.Add(imp.Path)
+		}
+	}
+}
+
+// An importChain is a sequence of imports leading from a project package to some dependency. Kinds[i] is the
+// kind of the import of Packages[i+1] by Packages[i].
+type importChain struct {
+	Packages []string
+	Kinds    []importKind
+}
+
+// TestOnly reports whether any import in c is a test import (which means that c is only relevant when
+// testing).
+func (c importChain) TestOnly() bool {
+	for _, kind := range c.Kinds {
+		if kind != normalImport {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats c as a list of packages separated by arrows. Test and xtest imports are marked on the arrow:
+// "a -> b -test-> c".
+func (c importChain) String() string {
+	parts := []string{c.Packages[0]}
+	for i, kind := range c.Kinds {
+		arrow := "->"
+		if kind != normalImport {
+			arrow = "-" + kind.String() + "->"
+		}
+		parts = append(parts, arrow, c.Packages[i+1])
+	}
+	return strings.Join(parts, " ")
+}
+
+func (c importChain) extend(pkg string, kind importKind) importChain {
+	return importChain{
+		Packages: append(append([]string(nil), c.Packages...), pkg),
+		Kinds:    append(append([]importKind(nil), c.Kinds...), kind),
+	}
+}
+
+// isTarget reports whether the package pkg is matched by target, which may name either a package or a
+// directory (such as a repo root) containing packages. Project packages are never matched.
+func (g *importGraph) isTarget(pkg, target string) bool {
+	return hasPathPrefix(pkg, target) && !g.ProjectPackages.Contains(pkg)
+}
+
+// ShortestChains returns all the shortest import chains leading from a project package to a package matched
+// by target.
+func (g *importGraph) ShortestChains(target string) []importChain {
+	// Breadth-first search from all the project packages at once, remembering every way of reaching each
+	// package at its minimum distance.
+	type parent struct {
+		pkg  string
+		kind importKind
+	}
+	dist := make(map[string]int)
+	parents := make(map[string][]parent)
+	var queue []string
+	for _, pkg := range g.ProjectPackages {
+		dist[pkg] = 0
+		queue = append(queue, pkg)
+	}
+	best := -1
+	var targets []string
+	for len(queue) > 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		if best >= 0 && dist[pkg] > best {
+			break
+		}
+		if g.isTarget(pkg, target) {
+			best = dist[pkg]
+			targets = append(targets, pkg)
+			continue
+		}
+		for _, imp := range g.Imports[pkg] {
+			d, ok := dist[imp.Path]
+			if !ok {
+				dist[imp.Path] = dist[pkg] + 1
+				queue = append(queue, imp.Path)
+			} else if d != dist[pkg]+1 {
+				continue
+			}
+			parents[imp.Path] = append(parents[imp.Path], parent{pkg, imp.Kind})
+		}
+	}
+
+	var chains []importChain
+	var walk func(pkg string, suffix importChain)
+	walk = func(pkg string, suffix importChain) {
+		if dist[pkg] == 0 {
+			chain := importChain{Packages: append([]string{pkg}, suffix.Packages...), Kinds: suffix.Kinds}
+			chains = append(chains, chain)
+			return
+		}
+		for _, p := range parents[pkg] {
+			walk(p.pkg, importChain{
+				Packages: append([]string{pkg}, suffix.Packages...),
+				Kinds:    append([]importKind{p.kind}, suffix.Kinds...),
+			})
+		}
+	}
+	for _, pkg := range targets {
+		walk(pkg, importChain{})
+	}
+	return chains
+}
+
+// AllChains returns every import chain (without repeated packages) leading from a project package to a package
+// matched by target.
+func (g *importGraph) AllChains(target string) []importChain {
+	var chains []importChain
+	onChain := make(map[string]bool)
+	var walk func(chain importChain)
+	walk = func(chain importChain) {
+		pkg := chain.Packages[len(chain.Packages)-1]
+		if g.isTarget(pkg, target) {
+			chains = append(chains, chain)
+			return
+		}
+		// A project package's tests only matter when the chain starts there (and we start a chain at each
+		// project package anyway).
+		noTests := len(chain.Packages) > 1 && g.ProjectPackages.Contains(pkg)
+		onChain[pkg] = true
+		for _, imp := range g.Imports[pkg] {
+			if onChain[imp.Path] || (noTests && imp.Kind != normalImport) {
+				continue
+			}
+			walk(chain.extend(imp.Path, imp.Kind))
+		}
+		onChain[pkg] = false
+	}
+	for _, pkg := range g.ProjectPackages {
+		walk(importChain{Packages: []string{pkg}})
+	}
+	return chains
+}
+
+func runGraph(root, gopath string, args []string) error {
+	fs := flag.NewFlagSet("graph", flag.ContinueOnError)
+	defaultFormat := "dot"
+	if jsonMode {
+		defaultFormat = "json"
+	}
+	format := fs.String("format", defaultFormat, "Output format (dot or json)")
+	level := fs.String("level", "package", "Graph granularity (package or repo)")
+	withDepTests := fs.Bool("with-dep-tests", false, "Include the test imports of dependencies")
+	buildOpts := new(BuildOptions)
+	addBuildFlags(fs, buildOpts)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments to graph: %v", args)
+	}
+	var write func(io.Writer, *exportedGraph) error
+	switch *format {
+	case "dot":
+		write = writeDOT
+	case "json":
+		write = writeGraphJSON
+	default:
+		return fmt.Errorf("unknown graph format %q (must be dot or json)", *format)
+	}
+	switch *level {
+	case "package", "repo":
+	default:
+		return fmt.Errorf("unknown graph level %q (must be package or repo)", *level)
+	}
+
+	matrix, err := newBuildMatrix(gopath, buildOpts)
+	if err != nil {
+		return err
+	}
+	graph, err := buildImportGraph(matrix, root, *withDepTests)
+	if err != nil {
+		return err
+	}
+	pinlist, err := loadPinlistIfExists(root)
+	if err != nil {
+		return err
+	}
+	cacheDir := config.cacheSrcDir(root)
+	return write(os.Stdout, graph.export(pinlist, cacheDir, *level == "repo"))
+}
+
+// An exportedGraph is the form of an import graph written out by 'glp graph'.
+type exportedGraph struct {
+	Nodes []graphNode `json:"nodes"`
+	Edges []graphEdge `json:"edges"`
+}
+
+type graphNode struct {
+	ID string `json:"id"`
+	// Kind is "project" (a project package), "package" (a dependency package), or "repo" (a dependency repo).
+	Kind string `json:"kind"`
+	// Repo is the root of the repo containing a dependency package.
+	Repo string `json:"repo,omitempty"`
+}
+
+type graphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Kind is the kind of import: "normal", "test", or "xtest".
+	Kind string `json:"kind"`
+}
+
+// export converts g into an exportedGraph. Dependency packages are assigned to repos using the pinlist, or
+// else the repos in cacheDir. If byRepo is true, dependency packages are collapsed into their repos; an edge
+// between two repos gets the first applicable kind (in the order normal, test, xtest) of the imports it
+// represents.
+func (g *importGraph) export(pinlist *Pinlist, cacheDir string, byRepo bool) *exportedGraph {
+	repoOf := func(pkg string) string {
+		if pinned := pinlist.FindPackage(pkg); pinned != nil {
+			return pinned.Root
+		}
+		if root, _, ok := findCachedRepo(cacheDir, pkg); ok {
+			return root
+		}
+		return pkg
+	}
+	nodeOf := func(pkg string) string {
+		if byRepo && !g.ProjectPackages.Contains(pkg) {
+			return repoOf(pkg)
+		}
+		return pkg
+	}
+
+	exported := new(exportedGraph)
+	var nodes smap
+	for _, pkg := range g.Packages {
+		id := nodeOf(pkg)
+		if nodes.Contains(id) {
+			continue
+		}
+		nodes.Add(id)
+		switch {
+		case g.ProjectPackages.Contains(pkg):
+			exported.Nodes = append(exported.Nodes, graphNode{ID: id, Kind: "project"})
+		case byRepo:
+			exported.Nodes = append(exported.Nodes, graphNode{ID: id, Kind: "repo"})
+		default:
+			exported.Nodes = append(exported.Nodes, graphNode{ID: id, Kind: "package", Repo: repoOf(pkg)})
+		}
+	}
+
+	type edgeKey struct{ from, to string }
+	kinds := make(map[edgeKey]importKind)
+	var keys []edgeKey
+	for _, pkg := range g.Packages {
+		for _, imp := range g.Imports[pkg] {
+			key := edgeKey{nodeOf(pkg), nodeOf(imp.Path)}
+			if key.from == key.to {
+				continue
+			}
+			kind, ok := kinds[key]
+			if !ok {
+				keys = append(keys, key)
+			}
+			if !ok || imp.Kind < kind {
+				kinds[key] = imp.Kind
+			}
+		}
+	}
+	for _, key := range keys {
+		exported.Edges = append(exported.Edges, graphEdge{From: key.from, To: key.to, Kind: kinds[key].String()})
+	}
+	sort.Sort(graphNodes(exported.Nodes))
+	sort.Sort(graphEdges(exported.Edges))
+	return exported
+}
+
+type graphNodes []graphNode
+
+func (n graphNodes) Len() int           { return len(n) }
+func (n graphNodes) Less(i, j int) bool { return n[i].ID < n[j].ID }
+func (n graphNodes) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+type graphEdges []graphEdge
+
+func (e graphEdges) Len() int { return len(e) }
+func (e graphEdges) Less(i, j int) bool {
+	if e[i].From != e[j].From {
+		return e[i].From < e[j].From
+	}
+	return e[i].To < e[j].To
+}
+func (e graphEdges) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+func writeGraphJSON(w io.Writer, g *exportedGraph) error {
+	b, err := json.MarshalIndent(g, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// writeDOT writes g in the Graphviz DOT language. Project packages are drawn as boxes, and dependency packages
+// are grouped into a cluster for each repo. Test and xtest imports are drawn dashed and dotted, respectively.
+func writeDOT(w io.Writer, g *exportedGraph) error {
+	var buf bytes.Buffer
+	buf.WriteString("digraph deps {\n")
+	buf.WriteString("\trankdir=LR;\n")
+	clusters := make(map[string][]string)
+	var clusterRepos smap
+	for _, node := range g.Nodes {
+		switch node.Kind {
+		case "project":
+			fmt.Fprintf(&buf, "\t%s [shape=box];\n", strconv.Quote(node.ID))
+		case "repo":
+			fmt.Fprintf(&buf, "\t%s [shape=folder];\n", strconv.Quote(node.ID))
+		default:
+			clusterRepos.Add(node.Repo)
+			clusters[node.Repo] = append(clusters[node.Repo], node.ID)
+		}
+	}
+	for i, repo := range clusterRepos {
+		fmt.Fprintf(&buf, "\tsubgraph cluster_%d {\n", i)
+		fmt.Fprintf(&buf, "\t\tlabel=%s;\n", strconv.Quote(repo))
+		for _, id := range clusters[repo] {
+			fmt.Fprintf(&buf, "\t\t%s;\n", strconv.Quote(id))
+		}
+		buf.WriteString("\t}\n")
+	}
+	for _, edge := range g.Edges {
+		attrs := ""
+		switch edge.Kind {
+		case "test":
+			attrs = ` [style=dashed, label="test"]`
+		case "xtest":
+			attrs = ` [style=dotted, label="xtest"]`
+		}
+		fmt.Fprintf(&buf, "\t%s -> %s%s;\n", strconv.Quote(edge.From), strconv.Quote(edge.To), attrs)
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
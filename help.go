@@ -2,19 +2,102 @@ package main
 
 const glpHelp = `glp -- dependency pinning for Go
 Usage:
-    %s COMMAND [OPTIONS]...
+    %s [--offline] [--json] COMMAND [OPTIONS]...
 glp provides several builtin commands. All other subcommands are delegated to
 the go tool using a modified $GOPATH for the glp project.
 
+With --offline (or if $GLP_OFFLINE is set), glp never accesses the network:
+repos are located using only the pinlist and the cache, and anything that is
+not already cached is an error.
+
+With --json, glp reports what it does as JSON objects on stdout, one per line.
+
 glp commands:
 
+add IMPORTPATH[@REV]... [-j N] [-platforms LIST] [-tags LIST]
+    Pin the given packages before the project imports them, and then sync.
+    The repo of each package is fetched and moved to REV (a revision, or a
+    tag or branch to follow from then on), or else to the latest upstream
+    revision if it is not pinned yet. Added packages and their dependencies
+    stay pinned even if nothing in the project imports them.
+export-mod [-module PATH] [-proxy DIR] [--force]
+    Write a go.mod and go.sum for the project (as module PATH, by default
+    the name of the project root) that require each pinned repo at exactly
+    its pinned revision, using a tag or a pseudo-version, and fail if the
+    dependencies' own go.mod files would select other versions. The
+    project's packages in src/ become local modules. With -proxy, the
+    dependency modules are also written to DIR in the layout of a module
+    proxy.
+graph [-format dot|json] [-level package|repo] [--with-dep-tests]
+      [-platforms LIST] [-tags LIST]
+    Print the import graph of the project and its dependencies in Graphviz
+    DOT (the default) or JSON format, with either packages or dependency
+    repos as nodes.
 help
     Show this help.
+import [--force] [FILE] [-j N] [--with-dep-tests] [-platforms LIST] [-tags LIST]
+    Create glp/deps.json from the pins of another tool: godep's
+    Godeps/Godeps.json, gpm's Godeps, or Johnny Deps' Depsfile (FILE, or the
+    first of these found in the project root), and then sync. Entries that
+    cannot be converted are reported and skipped. An existing glp/deps.json
+    is only replaced with --force.
+link [IMPORTPATH DIR]
+    Use DIR (a local copy of the pinned repo containing IMPORTPATH, such as a
+    checkout in which you are fixing it) instead of the pinned revision when
+    running go commands, until it is unlinked. Every command warns while a
+    repo is linked. With no arguments, list the linked repos.
 path
     Print the GOPATH with which glp calls the Go tool.
-sync
+prune [--force]
+    Remove repos from the cache (glp/_cache) that are not used by any
+    dependency in glp/deps.json. Asks for confirmation unless --force is given.
+status
+    Show the project root and GOPATH, the pinned and cached revision of each
+    dependency repo, repos fetched from a source override, cached repos that
+    are not pinned, and project imports that are not pinned. Nothing is
+    modified.
+sync [-j N] [-v] [--frozen] [--with-dep-tests] [-platforms LIST] [-tags LIST]
     Synchronize the project dependencies (from the source), the pinned
-    versions (in glp/deps.json), and the cache (glp/_cache).
+    versions (in glp/deps.json), and the cache (glp/_cache). Up to N (default
+    4) dependency repos are fetched in parallel. With --frozen, fail (and
+    show the differences) rather than change glp/deps.json. The test imports
+    of dependencies are only followed with --with-dep-tests. Dependencies are
+    found for every GOOS/GOARCH platform (or the comma-separated platforms
+    given with -platforms), with and without cgo and the -tags build tags.
+    With -v, report the directories that were not searched for packages.
+unlink IMPORTPATH... | unlink --all
+    Remove the links of the repos containing the given import paths (or all
+    links), so that go commands use the pinned revisions again.
+update [IMPORTPATH...] [--rev REV | --version VERSION] [-j N]
+    Update the repos containing the given pinned dependencies (or all
+    dependencies, if none are given) to the latest upstream revision, or to
+    REV if it is given, and then sync. A repo with a version (tag or branch)
+    moves along its branch or to the newest tag with the same major version;
+    --version switches it to VERSION. Accepts the same flags as sync.
+vendor [--check] [-dir DIR]
+    Copy every pinned repo from the cache into a vendor directory (without
+    VCS metadata) for use with Go's vendoring support, along with a manifest
+    (glp-vendor.json) recording each repo's revision. With --check, verify
+    that an existing vendor directory still matches glp/deps.json instead.
+verify [--strict]
+    Check that every pinned repo is cached at its pinned revision and that
+    its committed files match the hash recorded in glp/deps.json (naming
+    the files that differ, from glp/deps.sum). With --strict, recompute
+    every hash and fail on dirty repos.
+why [--all] [--with-dep-tests] [-platforms LIST] [-tags LIST] IMPORTPATH
+    Show the shortest chains of imports by which the project depends on
+    IMPORTPATH (a package or repo root), or every chain with --all. Test
+    imports are marked as -test-> or -xtest->.
+
+If $GLP_FROZEN is set, sync behaves as if --frozen were given, and other
+commands do not rewrite glp/deps.json.
+
+Project-level settings (extra source directories, ignored directories,
+excluded packages, disabled go commands, the cache location, default build
+options, and default flags for each command) can be given in glp/config.json.
+
+If $GLP_HOME is set, dependency repos are fetched once into a machine-wide
+store ($GLP_HOME/repos) that is shared by all glp projects.
 
 For more information, see https://github.com/cespare/glp.
 `
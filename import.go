@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// importFormats lists the pin files of other tools that glp can import, in the order in which they are looked
+// for in the project root.
+var importFormats = []struct {
+	name     string
+	filename string
+	read     func(filename string) ([]importedDep, []importProblem, error)
+}{
+	{"godep", filepath.Join("Godeps", "Godeps.json"), readGodepsJSON},
+	{"gpm", "Godeps", readDepsLines},
+	{"Johnny Deps", "Depsfile", readDepsLines},
+}
+
+// An importedDep is a dependency read from another tool's pin file.
+type importedDep struct {
+	Line       int
+	ImportPath string
+	// Version is the pinned version, which may be a revision, tag, or branch.
+	Version string
+}
+
+// An importProblem is an entry in another tool's pin file that could not be converted.
+type importProblem struct {
+	Line       int
+	ImportPath string
+	Reason     string
+}
+
+type importProblems []importProblem
+
+func (p importProblems) Len() int           { return len(p) }
+func (p importProblems) Less(i, j int) bool { return p[i].Line < p[j].Line }
+func (p importProblems) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func runImport(root, gopath string, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	force := fs.Bool("force", false, "Replace an existing glp/deps.json")
+	opts := new(SyncOptions)
+	addSyncFlags(fs, opts)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return errors.New("usage: glp import [--force] [FILE]")
+	}
+	filename := ""
+	if len(args) == 1 {
+		filename = args[0]
+	}
+	return Import(root, gopath, filename, *force, opts)
+}
+
+// Import converts the pin file of another dependency tool (godep's Godeps/Godeps.json, gpm's Godeps, or Johnny
+// Deps' Depsfile) into a pinlist for the project located at root and then syncs the project (using opts). If
+// filename is empty, the project root is searched for a pin file. An existing pinlist is only replaced if
+// force is true.
+//   - Each entry is mapped to its repo, which is cloned into the cache and checked out at the entry's
+//     version (a revision, tag, or branch) to find the full revision to pin
+//   - Entries that cannot be converted are reported and left out of the pinlist (sync pins them at the latest
+//     revision if the project uses them)
+//   - The pinlist is written out, and the project is synced
+func Import(root, gopath, filename string, force bool, opts *SyncOptions) error {
+	pinlistFilename := filepath.Join(root, projectDirName, pinlistName)
+	if frozenMode {
+		return fmt.Errorf("cannot import into %s because $GLP_FROZEN is set", pinlistFilename)
+	}
+	if _, err := os.Stat(pinlistFilename); err == nil && !force {
+		return fmt.Errorf("%s already exists (use --force to replace it)", pinlistFilename)
+	}
+
+	read := readDepsLines
+	if filename == "" {
+		for _, format := range importFormats {
+			name := filepath.Join(root, format.filename)
+			if stat, err := os.Stat(name); err == nil && !stat.IsDir() {
+				filename = name
+				read = format.read
+				break
+			}
+		}
+		if filename == "" {
+			var names []string
+			for _, format := range importFormats {
+				names = append(names, fmt.Sprintf("%s (%s)", format.filename, format.name))
+			}
+			return fmt.Errorf("no pin file found to import (looked for %s)", strings.Join(names, ", "))
+		}
+	} else if filepath.Ext(filename) == ".json" {
+		read = readGodepsJSON
+	}
+	deps, problems, err := read(filename)
+	if err != nil {
+		return err
+	}
+	textf("Importing %s\n", filename)
+
+	cacheDir := config.cacheSrcDir(root)
+	pinlist := new(Pinlist)
+	versions := make(map[string]string) // repo root -> version of the first entry for the repo
+	for _, dep := range deps {
+		problem := func(format string, args ...interface{}) {
+			problems = append(problems, importProblem{dep.Line, dep.ImportPath, fmt.Sprintf(format, args...)})
+		}
+		repo, err := lookupRepoRoot(dep.ImportPath, cacheDir)
+		if err != nil {
+			problem("%s", err)
+			continue
+		}
+		switch repo.VCS.Cmd.Cmd {
+		case "git", "hg":
+		default:
+			problem("%s is not a VCS supported by glp", repo.VCS.Cmd.Name)
+			continue
+		}
+		dir := filepath.Join(cacheDir, repo.Root)
+		pinned := pinlist.Find(repo.Root)
+		if pinned == nil {
+			rev, err := updateRepo(repo, dir, dep.Version)
+			if err != nil {
+				problem("cannot find version %s: %s", dep.Version, err)
+				continue
+			}
+			pinlist.Repos = append(pinlist.Repos, PinnedRepo{
+				Root:     repo.Root,
+				URL:      repo.Repo,
+				VCS:      repo.VCS.Cmd.Cmd,
+				Rev:      rev,
+				Packages: []string{dep.ImportPath},
+			})
+			versions[repo.Root] = dep.Version
+			continue
+		}
+		if dep.Version != versions[repo.Root] {
+			// Check whether the two versions name the same revision, and then go back to the first one.
+			rev, err := updateRepo(repo, dir, dep.Version)
+			if err == nil {
+				err = repo.VCS.UpdateRev(dir, pinned.Rev)
+			}
+			if err != nil {
+				problem("cannot find version %s: %s", dep.Version, err)
+				continue
+			}
+			if rev != pinned.Rev {
+				problem("version %s conflicts with version %s of another package in repo %s",
+					dep.Version, versions[repo.Root], repo.Root)
+				continue
+			}
+		}
+		pinned.Packages = append(pinned.Packages, dep.ImportPath)
+	}
+
+	sort.Sort(importProblems(problems))
+	for _, p := range problems {
+		warnEvent("import-skipped",
+			eventFields{"file": filename, "line": p.Line, "package": p.ImportPath, "reason": p.Reason},
+			"%s:%d: skipping %s: %s\n", filename, p.Line, p.ImportPath, p.Reason)
+	}
+	logEvent("imported", eventFields{"file": filename, "repos": len(pinlist.Repos), "skipped": len(problems)},
+		"Imported %d repos from %s (%d entries skipped).\n", len(pinlist.Repos), filename, len(problems))
+
+	if err := pinlist.Save(pinlistFilename); err != nil {
+		return err
+	}
+	return Sync(root, gopath, opts)
+}
+
+// readGodepsJSON reads the dependencies from godep's Godeps/Godeps.json. The line of each entry is the line of
+// its ImportPath.
+func readGodepsJSON(filename string) ([]importedDep, []importProblem, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var godeps struct {
+		Deps []struct {
+			ImportPath string
+			Rev        string
+		}
+	}
+	if err := json.Unmarshal(b, &godeps); err != nil {
+		return nil, nil, fmt.Errorf("cannot read %s: %s", filename, err)
+	}
+
+	// encoding/json doesn't report positions, so find the lines by looking for the ImportPath keys that follow
+	// the Deps key (there is one for each entry).
+	var lines []int
+	if i := bytes.Index(b, []byte(`"Deps"`)); i >= 0 {
+		line := bytes.Count(b[:i], []byte("\n")) + 1
+		for _, text := range bytes.Split(b[i:], []byte("\n")) {
+			if bytes.Contains(text, []byte(`"ImportPath"`)) {
+				lines = append(lines, line)
+			}
+			line++
+		}
+	}
+
+	var deps []importedDep
+	var problems []importProblem
+	for i, dep := range godeps.Deps {
+		line := 0
+		if len(lines) == len(godeps.Deps) {
+			line = lines[i]
+		}
+		switch {
+		case dep.ImportPath == "":
+			problems = append(problems, importProblem{line, dep.ImportPath, "no import path"})
+		case dep.Rev == "":
+			problems = append(problems, importProblem{line, dep.ImportPath, "no rev"})
+		default:
+			deps = append(deps, importedDep{line, dep.ImportPath, dep.Rev})
+		}
+	}
+	return deps, problems, nil
+}
+
+// readDepsLines reads the dependencies from a file with an import path and a version on each line, which is
+// the format of both gpm's Godeps and Johnny Deps' Depsfile. Comments start with #.
+func readDepsLines(filename string) ([]importedDep, []importProblem, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var deps []importedDep
+	var problems []importProblem
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		switch {
+		case len(fields) == 0:
+		case len(fields) == 1:
+			problems = append(problems, importProblem{line, fields[0], "no version"})
+		case len(fields) > 2 || strings.ContainsAny(fields[1], "<>=~^*"):
+			reason := fmt.Sprintf("version range %q is not supported", strings.Join(fields[1:], " "))
+			problems = append(problems, importProblem{line, fields[0], reason})
+		default:
+			deps = append(deps, importedDep{line, fields[0], fields[1]})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return deps, problems, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTempFile writes contents to a file in a new temporary directory and returns its name. The caller removes
+// the directory.
+func writeTempFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "glp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadGodepsJSON(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		contents     string
+		wantDeps     []importedDep
+		wantProblems []importProblem
+	}{
+		{
+			name: "one entry per line",
+			contents: `{
+	"ImportPath": "example.com/project",
+	"GoVersion": "go1.5",
+	"Deps": [
+		{
+			"ImportPath": "github.com/a/b",
+			"Comment": "v1.0",
+			"Rev": "abc"
+		},
+		{
+			"ImportPath": "github.com/c/d/e",
+			"Rev": ""
+		},
+		{"ImportPath": "", "Rev": "def"},
+		{
+			"ImportPath": "github.com/g/h",
+			"Rev": "123"
+		}
+	]
+}
+`,
+			wantDeps: []importedDep{{6, "github.com/a/b", "abc"}, {16, "github.com/g/h", "123"}},
+			wantProblems: []importProblem{
+				{11, "github.com/c/d/e", "no rev"},
+				{14, "", "no import path"},
+			},
+		},
+		{
+			name: "lines unknown",
+			contents: `{"Deps": [{"ImportPath": "github.com/a/b", "Rev": "abc"}, ` +
+				`{"ImportPath": "github.com/c/d", "Rev": ""}]}` + "\n",
+			wantDeps:     []importedDep{{0, "github.com/a/b", "abc"}},
+			wantProblems: []importProblem{{0, "github.com/c/d", "no rev"}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := writeTempFile(t, "Godeps.json", tt.contents)
+			defer os.RemoveAll(filepath.Dir(filename))
+			deps, problems, err := readGodepsJSON(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(deps, tt.wantDeps) {
+				t.Errorf("got deps %v; want %v", deps, tt.wantDeps)
+			}
+			if !reflect.DeepEqual(problems, tt.wantProblems) {
+				t.Errorf("got problems %v; want %v", problems, tt.wantProblems)
+			}
+		})
+	}
+}
+
+func TestReadDepsLines(t *testing.T) {
+	filename := writeTempFile(t, "Godeps", `# comment
+github.com/a/b v1.0
+
+github.com/c/d	abc # pinned
+github.com/e/f
+github.com/g/h >= 1.0
+github.com/i/j ~1.2
+    # indented comment
+github.com/k/l def
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+	deps, problems, err := readDepsLines(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDeps := []importedDep{
+		{2, "github.com/a/b", "v1.0"},
+		{4, "github.com/c/d", "abc"},
+		{9, "github.com/k/l", "def"},
+	}
+	if !reflect.DeepEqual(deps, wantDeps) {
+		t.Errorf("got deps %v; want %v", deps, wantDeps)
+	}
+	wantProblems := []importProblem{
+		{5, "github.com/e/f", "no version"},
+		{6, "github.com/g/h", `version range ">= 1.0" is not supported`},
+		{7, "github.com/i/j", `version range "~1.2" is not supported`},
+	}
+	if !reflect.DeepEqual(problems, wantProblems) {
+		t.Errorf("got problems %v; want %v", problems, wantProblems)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A link replaces a pinned repo with a local directory (such as a checkout in which the dependency is being
+// developed). Links are symlinks in the links directory (glp/_links/src/<repo root>), which is put on the
+// GOPATH ahead of the cache, so that passthrough go commands build against the linked directory rather than the
+// pinned copy. The links directory only exists while there are links.
+
+const linksDirName = "_links"
+
+// linksDir returns the links directory of the project located at root. This is the GOPATH entry; the links
+// themselves are in its src/ directory.
+func linksDir(root string) string {
+	return filepath.Join(root, projectDirName, linksDirName)
+}
+
+// findLinks returns the links in the project located at root, mapping each linked repo root to the directory
+// it is linked to.
+func findLinks(root string) (map[string]string, error) {
+	src := filepath.Join(linksDir(root), "src")
+	links := make(map[string]string)
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == src {
+				return nil
+			}
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		links[filepath.ToSlash(rel)] = target
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func runLink(root string, args []string) error {
+	fs := flag.NewFlagSet("link", flag.ContinueOnError)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	switch len(args) {
+	case 0:
+		return ListLinks(root)
+	case 2:
+		return Link(root, args[0], args[1])
+	}
+	return errors.New("usage: glp link [IMPORTPATH DIR]")
+}
+
+func runUnlink(root string, args []string) error {
+	fs := flag.NewFlagSet("unlink", flag.ContinueOnError)
+	all := fs.Bool("all", false, "Remove every link")
+	importPaths, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if *all == (len(importPaths) > 0) {
+		return errors.New("usage: glp unlink IMPORTPATH... | glp unlink --all")
+	}
+	return Unlink(root, importPaths, *all)
+}
+
+// Link links the pinned repo containing importPath to dir, which should be a copy of the repo (its root, not
+// the directory of the package importPath). The cache and the pinlist are not changed.
+func Link(root, importPath, dir string) error {
+	pinlist, err := loadRequiredPinlist(root)
+	if err != nil {
+		return err
+	}
+	pinned := pinlist.FindPackage(importPath)
+	if pinned == nil {
+		return fmt.Errorf("%s is not a pinned dependency (only pinned repos can be linked)", importPath)
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	links, err := findLinks(root)
+	if err != nil {
+		return err
+	}
+	for linked := range links {
+		if linked != pinned.Root && (hasPathPrefix(linked, pinned.Root) || hasPathPrefix(pinned.Root, linked)) {
+			return fmt.Errorf("repo %s is nested in linked repo %s (or the reverse); unlink it first",
+				pinned.Root, linked)
+		}
+	}
+	link := filepath.Join(linksDir(root), "src", filepath.FromSlash(pinned.Root))
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(dir, link); err != nil {
+		return err
+	}
+	logEvent("repo-linked", eventFields{"repo": pinned.Root, "dir": dir, "rev": pinned.Rev},
+		"Linked dep repo %s to %s (instead of pinned rev %s).\n", pinned.Root, dir, pinned.Rev)
+	return nil
+}
+
+// ListLinks prints the links in the project located at root.
+func ListLinks(root string) error {
+	links, err := findLinks(root)
+	if err != nil {
+		return err
+	}
+	if len(links) == 0 {
+		textf("No linked repos.\n")
+		return nil
+	}
+	var repos smap
+	for repo := range links {
+		repos.Add(repo)
+	}
+	textf("Linked repos:\n")
+	for _, repo := range repos {
+		logEvent("repo-linked", eventFields{"repo": repo, "dir": links[repo]}, "\t%s -> %s\n", repo, links[repo])
+	}
+	return nil
+}
+
+// Unlink removes the links of the repos containing importPaths (or every link, if all is true), so that the
+// pinned copies in the cache are used again. The links directory is removed once there are no links left.
+func Unlink(root string, importPaths []string, all bool) error {
+	links, err := findLinks(root)
+	if err != nil {
+		return err
+	}
+	var repos smap
+	if all {
+		for repo := range links {
+			repos.Add(repo)
+		}
+	}
+	for _, importPath := range importPaths {
+		found := false
+		for repo := range links {
+			if hasPathPrefix(importPath, repo) {
+				repos.Add(repo)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s is not in a linked repo", importPath)
+		}
+	}
+
+	src := filepath.Join(linksDir(root), "src")
+	for _, repo := range repos {
+		link := filepath.Join(src, filepath.FromSlash(repo))
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+		// Clean up the parent directories that are now empty.
+		for dir := filepath.Dir(link); strings.HasPrefix(dir, src); dir = filepath.Dir(dir) {
+			if err := os.Remove(dir); err != nil {
+				break
+			}
+		}
+		logEvent("repo-unlinked", eventFields{"repo": repo, "dir": links[repo]},
+			"Unlinked dep repo %s (was %s); builds use the pinned copy again.\n", repo, links[repo])
+	}
+	if len(repos) == len(links) {
+		return os.RemoveAll(linksDir(root))
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Manifest lists the files committed at the pinned rev of each repo, mapping the repo root to its files
+// (as returned by VCSCmd.CommittedFiles). It is stored in glp/deps.sum, next to the pinlist, with a line
+// "<repo root> <SHA-256 hash> <path>" for each file.
+//
+// A repo's pinned hash is the checksum of its files (see hashFiles), so the manifest adds nothing to what is
+// checked. It is only used to name the files that differ when a repo doesn't match its pinned hash.
+type Manifest map[string]map[string][]byte
+
+// loadManifest reads the manifest of the project located at root. If there is no manifest, an empty one is
+// returned.
+func loadManifest(root string) (Manifest, error) {
+	filename := filepath.Join(root, projectDirName, manifestName)
+	m := make(Manifest)
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: malformed line", filename, line)
+		}
+		sum, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: malformed hash: %s", filename, line, err)
+		}
+		if m[fields[0]] == nil {
+			m[fields[0]] = make(map[string][]byte)
+		}
+		m[fields[0]][fields[2]] = sum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Save writes m to filename, with the repos in order and the files of each in the order used by hashFiles. If m
+// is empty, filename is removed instead.
+func (m Manifest) Save(filename string) error {
+	var roots []string
+	for root := range m {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	var b bytes.Buffer
+	for _, root := range roots {
+		var paths walkOrder
+		for path := range m[root] {
+			paths = append(paths, path)
+		}
+		sort.Sort(paths)
+		for _, path := range paths {
+			fmt.Fprintf(&b, "%s %x %s\n", root, m[root][path], path)
+		}
+	}
+	if b.Len() == 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(filename, b.Bytes(), 0644)
+}
+
+// files returns the files of the pinned repo, or nil if m has none that match its pinned hash.
+func (m Manifest) files(pinned *PinnedRepo) map[string][]byte {
+	files := m[pinned.Root]
+	if files == nil || pinned.Hash == "" || hashFiles(files) != pinned.Hash {
+		return nil
+	}
+	return files
+}
+
+// diffFiles lists the files that were added, removed, or modified in going from old to new (each a map from
+// path to hash, as in a Manifest), sorted by path.
+func diffFiles(old, new map[string][]byte) []FileChange {
+	var changes []FileChange
+	for path, sum := range new {
+		oldSum, ok := old[path]
+		switch {
+		case !ok:
+			changes = append(changes, FileChange{Path: path, Status: "added"})
+		case !bytes.Equal(sum, oldSum):
+			changes = append(changes, FileChange{Path: path, Status: "modified"})
+		}
+	}
+	for path := range old {
+		if _, ok := new[path]; !ok {
+			changes = append(changes, FileChange{Path: path, Status: "removed"})
+		}
+	}
+	sort.Sort(fileChanges(changes))
+	return changes
+}
+
+type fileChanges []FileChange
+
+func (c fileChanges) Len() int           { return len(c) }
+func (c fileChanges) Less(i, j int) bool { return c[i].Path < c[j].Path }
+func (c fileChanges) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifestSaveLoad(t *testing.T) {
+	root, err := ioutil.TempDir("", "glp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.Mkdir(filepath.Join(root, projectDirName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(root, projectDirName, manifestName)
+
+	m := Manifest{
+		"example.com/b": {"b.go": []byte{1, 2}},
+		"example.com/a": {"a.go": []byte{3}, "a/b c.go": []byte{4}, "z.go": []byte{5}},
+	}
+	if err := m.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "example.com/a 04 a/b c.go\nexample.com/a 03 a.go\nexample.com/a 05 z.go\nexample.com/b 0102 b.go\n"
+	if string(b) != want {
+		t.Errorf("Save: got\n%s\nwant\n%s", b, want)
+	}
+	loaded, err := loadManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, m) {
+		t.Errorf("loadManifest: got %v; want %v", loaded, m)
+	}
+
+	// An empty manifest isn't saved.
+	if err := make(Manifest).Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Save of an empty manifest: got Stat error %v; want not-exist", err)
+	}
+	if loaded, err := loadManifest(root); err != nil || len(loaded) != 0 {
+		t.Errorf("loadManifest without a manifest: got %v, %v; want an empty manifest", loaded, err)
+	}
+}
+
+func TestManifestFiles(t *testing.T) {
+	files := map[string][]byte{"a.go": []byte{1}}
+	m := Manifest{"example.com/a": files}
+	for _, tt := range []struct {
+		repo PinnedRepo
+		want map[string][]byte
+	}{
+		{PinnedRepo{Root: "example.com/a", Hash: hashFiles(files)}, files},
+		{PinnedRepo{Root: "example.com/a", Hash: "sha256:00"}, nil},
+		{PinnedRepo{Root: "example.com/a"}, nil},
+		{PinnedRepo{Root: "example.com/b", Hash: hashFiles(files)}, nil},
+	} {
+		if got := m.files(&tt.repo); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("files(%s with hash %q): got %v; want %v", tt.repo.Root, tt.repo.Hash, got, tt.want)
+		}
+	}
+}
+
+func TestDiffFiles(t *testing.T) {
+	old := map[string][]byte{"a.go": []byte{1}, "b.go": []byte{2}, "c.go": []byte{3}}
+	new := map[string][]byte{"a.go": []byte{1}, "b.go": []byte{4}, "d/e.go": []byte{5}}
+	want := []FileChange{{"b.go", "modified"}, {"c.go", "removed"}, {"d/e.go", "added"}}
+	if got := diffFiles(old, new); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	if got := diffFiles(old, old); len(got) != 0 {
+		t.Errorf("got %v for identical files; want none", got)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// In JSON mode (glp --json), glp reports what it is doing as a stream of JSON objects on stdout, one per
+// line, rather than printing human-readable messages. Each object has an "event" field naming the kind of
+// event (for instance, "repo-fetched" or "error") along with fields specific to that event.
+
+var (
+	jsonMode = false
+	outputMu sync.Mutex
+)
+
+type eventFields map[string]interface{}
+
+// logEvent reports an event. In JSON mode, the event is written to stdout; otherwise, the message given by
+// format and args is printed to stdout (or nothing is printed, if format is empty).
+func logEvent(name string, fields eventFields, format string, args ...interface{}) {
+	emit(os.Stdout, name, fields, format, args...)
+}
+
+// warnEvent is like logEvent, but the message (if any) is printed to stderr.
+func warnEvent(name string, fields eventFields, format string, args ...interface{}) {
+	emit(os.Stderr, name, fields, format, args...)
+}
+
+// textf prints a message that has no corresponding event (such as a heading) to stdout. It prints nothing in
+// JSON mode.
+func textf(format string, args ...interface{}) {
+	if jsonMode {
+		return
+	}
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	fmt.Printf(format, args...)
+}
+
+func emit(w io.Writer, name string, fields eventFields, format string, args ...interface{}) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	if !jsonMode {
+		if format != "" {
+			fmt.Fprintf(w, format, args...)
+		}
+		return
+	}
+	event := map[string]interface{}{"event": name}
+	for k, v := range fields {
+		event[k] = v
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		panic(err)
+	}
+	os.Stdout.Write(append(b, '\n'))
+}
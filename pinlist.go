@@ -1,23 +1,76 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/vcs"
 )
 
-// A Pinlist represents a pinned list of dependencies.
+// A Pinlist represents a pinned list of dependencies, grouped by the repos that contain them.
 type Pinlist struct {
-	Deps []Dep `json:"deps"`
+	Repos []PinnedRepo `json:"repos"`
 }
 
-// A Dep is a third-party package dependency.
-type Dep struct {
-	// Name is the import path of the package.
-	Name string `json:"name"`
+// A PinnedRepo is a third-party repo containing one or more package dependencies, pinned at a single
+// revision.
+type PinnedRepo struct {
+	// Root is the import path corresponding to the root of the repo.
+	Root string `json:"root"`
+	// URL is the location of the repo, including the scheme.
+	URL string `json:"url"`
+	// Source, if set, is the location from which the repo is actually fetched (such as a fork with the same
+	// import path, or a local mirror). URL still records the upstream location.
+	Source string `json:"source,omitempty"`
+	// VCS is the version control command used for the repo ("git" or "hg").
+	VCS string `json:"vcs"`
 	// Rev is the VCS revision number (e.g., git SHA-1 hash).
 	Rev string `json:"rev"`
+	// Version, if set, is the tag or branch that the repo is meant to be on. Rev is still the exact revision
+	// that is used: sync resolves a tag to its revision (and fills in Rev from a branch if it is empty), and
+	// update moves the repo along the branch or to the newest tag with the same major version.
+	Version string `json:"version,omitempty"`
+	// Hash is a checksum of the files committed at Rev (see hashRepo), recorded by sync. It is checked whenever
+	// the repo is synced and before each go command (and fully recomputed by 'glp verify --strict'), to catch
+	// rewritten upstream history or a tampered cache.
+	Hash string `json:"hash,omitempty"`
+	// Packages lists the import paths of the packages used from the repo.
+	Packages []string `json:"packages"`
+	// Explicit lists the packages that were added with 'glp add'. Sync keeps them (and their transitive
+	// deps) pinned whether or not the project imports them.
+	Explicit []string `json:"explicit,omitempty"`
+	// Scope is prodScope if the project's non-test code needs the repo and testScope if only tests need it.
+	Scope depScope `json:"scope,omitempty"`
+	// Platforms lists the platforms (as GOOS/GOARCH) on which the repo is needed. It is empty if the repo is
+	// needed on every platform that glp considered.
+	Platforms []string `json:"platforms,omitempty"`
+}
+
+// A depScope says whether a dependency is needed by production code or only by tests.
+type depScope string
+
+const (
+	prodScope depScope = "prod"
+	testScope depScope = "test"
+)
+
+// pinlistFile is the on-disk format of a pinlist. Deps is the pre-repo (one entry per package) format, which
+// is migrated on load.
+type pinlistFile struct {
+	Repos []PinnedRepo `json:"repos"`
+	Deps  []legacyDep  `json:"deps,omitempty"`
+}
+
+type legacyDep struct {
+	Name string `json:"name"`
+	Rev  string `json:"rev"`
 }
 
 func LoadPinlist(filename string) (p *Pinlist, err error) {
@@ -34,39 +87,273 @@ func LoadPinlist(filename string) (p *Pinlist, err error) {
 	}
 	defer f.Close()
 	decoder := json.NewDecoder(f)
-	p = new(Pinlist)
-	if err := decoder.Decode(p); err != nil {
+	var pf pinlistFile
+	if err := decoder.Decode(&pf); err != nil {
 		return nil, err
 	}
+	p = &Pinlist{Repos: pf.Repos}
+	if len(pf.Deps) > 0 {
+		if len(pf.Repos) > 0 {
+			return nil, errors.New(`pinlist has both "repos" and (old-style) "deps" entries`)
+		}
+		cacheDir := config.cacheSrcDir(filepath.Dir(filepath.Dir(filename)))
+		if err := p.migrate(pf.Deps, cacheDir); err != nil {
+			return nil, err
+		}
+	}
 	if err := p.validate(); err != nil {
 		return nil, err
 	}
+	p.normalize()
 	return p, nil
 }
 
+// migrate fills in p.Repos from a list of deps in the old, per-package pinlist format. cacheDir is the cache
+// directory of the project, which is used to look up repos in offline mode.
+func (p *Pinlist) migrate(deps []legacyDep, cacheDir string) error {
+	repos := make(map[string]*PinnedRepo)
+	for _, dep := range deps {
+		if dep.Name == "" {
+			return validationErr{errors.New("bad dep name (empty string)")}
+		}
+		repo, err := lookupRepoRoot(dep.Name, cacheDir)
+		if err != nil {
+			return err
+		}
+		pinned, ok := repos[repo.Root]
+		if !ok {
+			pinned = &PinnedRepo{
+				Root: repo.Root,
+				URL:  repo.Repo,
+				VCS:  repo.VCS.Cmd.Cmd,
+				Rev:  dep.Rev,
+			}
+			repos[repo.Root] = pinned
+		}
+		if pinned.Rev != dep.Rev {
+			return fmt.Errorf("Multiple packages with conflicting revs map to the repo %s", repo.Root)
+		}
+		pinned.Packages = append(pinned.Packages, dep.Name)
+	}
+	for _, pinned := range repos {
+		p.Repos = append(p.Repos, *pinned)
+	}
+	return nil
+}
+
 func (p *Pinlist) Save(filename string) error {
-	p.normalize()
-	f, err := os.Create(filename)
+	b, err := p.marshal()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	b, err := json.MarshalIndent(p, "", "\t")
+	f, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 	_, err = f.Write(b)
 	return err
 }
 
-type deps []Dep
+// marshal normalizes p and returns its on-disk representation.
+func (p *Pinlist) marshal() ([]byte, error) {
+	p.normalize()
+	return json.MarshalIndent(p, "", "\t")
+}
+
+// IsSavedAs reports whether the file filename contains exactly what Save would write for p.
+func (p *Pinlist) IsSavedAs(filename string) (bool, error) {
+	b, err := p.marshal()
+	if err != nil {
+		return false, err
+	}
+	saved, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(b, saved), nil
+}
+
+// Diff returns a human-readable list of the changes (added and removed repos and packages, and changed repo
+// details) needed to go from p to other. Both pinlists must be normalized.
+func (p *Pinlist) Diff(other *Pinlist) []string {
+	var diffs []string
+	for _, repo := range p.Repos {
+		if other.Find(repo.Root) == nil {
+			diffs = append(diffs, fmt.Sprintf("- repo %s at rev %s", repo.Root, repo.Rev))
+		}
+	}
+	for _, newRepo := range other.Repos {
+		repo := p.Find(newRepo.Root)
+		if repo == nil {
+			diffs = append(diffs, fmt.Sprintf("+ repo %s at rev %s", newRepo.Root, newRepo.Rev))
+			for _, pkg := range newRepo.Packages {
+				diffs = append(diffs, fmt.Sprintf("+ package %s", pkg))
+			}
+			continue
+		}
+		if repo.Rev != newRepo.Rev {
+			diffs = append(diffs, fmt.Sprintf("~ repo %s: rev %s -> %s", repo.Root, repo.Rev, newRepo.Rev))
+		}
+		if repo.Hash != newRepo.Hash {
+			diffs = append(diffs, fmt.Sprintf("~ repo %s: hash %s -> %s",
+				repo.Root, hashName(repo.Hash), hashName(newRepo.Hash)))
+		}
+		if repo.Version != newRepo.Version {
+			diffs = append(diffs, fmt.Sprintf("~ repo %s: version %s -> %s",
+				repo.Root, versionName(repo.Version), versionName(newRepo.Version)))
+		}
+		if repo.URL != newRepo.URL {
+			diffs = append(diffs, fmt.Sprintf("~ repo %s: url %s -> %s", repo.Root, repo.URL, newRepo.URL))
+		}
+		if repo.Source != newRepo.Source {
+			diffs = append(diffs, fmt.Sprintf("~ repo %s: source %s -> %s",
+				repo.Root, sourceName(repo.Source), sourceName(newRepo.Source)))
+		}
+		if repo.VCS != newRepo.VCS {
+			diffs = append(diffs, fmt.Sprintf("~ repo %s: vcs %s -> %s", repo.Root, repo.VCS, newRepo.VCS))
+		}
+		if repo.Scope != newRepo.Scope {
+			diffs = append(diffs, fmt.Sprintf("~ repo %s: scope %s -> %s", repo.Root, repo.Scope, newRepo.Scope))
+		}
+		oldPlatforms, newPlatforms := platformList(repo.Platforms), platformList(newRepo.Platforms)
+		if oldPlatforms != newPlatforms {
+			diffs = append(diffs, fmt.Sprintf("~ repo %s: platforms %s -> %s", repo.Root, oldPlatforms,
+				newPlatforms))
+		}
+		oldPackages, newPackages := smap(repo.Packages), smap(newRepo.Packages)
+		for _, pkg := range oldPackages {
+			if !newPackages.Contains(pkg) {
+				diffs = append(diffs, fmt.Sprintf("- package %s", pkg))
+			}
+		}
+		for _, pkg := range newPackages {
+			if !oldPackages.Contains(pkg) {
+				diffs = append(diffs, fmt.Sprintf("+ package %s", pkg))
+			}
+		}
+		oldExplicit, newExplicit := smap(repo.Explicit), smap(newRepo.Explicit)
+		for _, pkg := range oldExplicit {
+			if !newExplicit.Contains(pkg) {
+				diffs = append(diffs, fmt.Sprintf("- explicit package %s", pkg))
+			}
+		}
+		for _, pkg := range newExplicit {
+			if !oldExplicit.Contains(pkg) {
+				diffs = append(diffs, fmt.Sprintf("+ explicit package %s", pkg))
+			}
+		}
+	}
+	return diffs
+}
+
+// Find returns the pinned repo with the given root, or nil if there is none.
+func (p *Pinlist) Find(root string) *PinnedRepo {
+	for i := range p.Repos {
+		if p.Repos[i].Root == root {
+			return &p.Repos[i]
+		}
+	}
+	return nil
+}
+
+// FindPackage returns the pinned repo containing the package importPath, or nil if there is none.
+func (p *Pinlist) FindPackage(importPath string) *PinnedRepo {
+	var found *PinnedRepo
+	for i := range p.Repos {
+		repo := &p.Repos[i]
+		if hasPathPrefix(importPath, repo.Root) && (found == nil || len(repo.Root) > len(found.Root)) {
+			found = repo
+		}
+	}
+	return found
+}
+
+// RepoRootForImportPath is like lookupRepoRoot, but if importPath belongs to one of the repos in p, the pinned
+// repo information is used instead of looking it up.
+func (p *Pinlist) RepoRootForImportPath(importPath, cacheDir string) (*RepoRoot, error) {
+	if pinned := p.FindPackage(importPath); pinned != nil {
+		return pinned.RepoRoot(), nil
+	}
+	return lookupRepoRoot(importPath, cacheDir)
+}
+
+// RepoRoot returns the RepoRoot described by r. A repo with a source override doesn't use the shared repo
+// store, whose copy of the repo comes from upstream.
+func (r *PinnedRepo) RepoRoot() *RepoRoot {
+	repo := newRepoRoot(vcs.ByCmd(r.VCS), r.URL, r.Root)
+	if r.Source != "" {
+		repo.Source = r.Source
+		repo.VCS.store = ""
+	}
+	return repo
+}
+
+// hasPathPrefix reports whether the import path s is prefix or lies beneath it.
+func hasPathPrefix(s, prefix string) bool {
+	return s == prefix || strings.HasPrefix(s, prefix+"/")
+}
 
-func (d deps) Len() int           { return len(d) }
-func (d deps) Less(i, j int) bool { return d[i].Name < d[j].Name }
-func (d deps) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+type pinnedRepos []PinnedRepo
+
+func (r pinnedRepos) Len() int           { return len(r) }
+func (r pinnedRepos) Less(i, j int) bool { return r[i].Root < r[j].Root }
+func (r pinnedRepos) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
 
 func (p *Pinlist) normalize() {
-	sort.Sort(deps(p.Deps))
+	sort.Sort(pinnedRepos(p.Repos))
+	for i := range p.Repos {
+		var packages smap
+		for _, pkg := range p.Repos[i].Packages {
+			packages.Add(pkg)
+		}
+		p.Repos[i].Packages = packages
+		var explicit smap
+		for _, pkg := range p.Repos[i].Explicit {
+			explicit.Add(pkg)
+		}
+		p.Repos[i].Explicit = explicit
+		var platforms smap
+		for _, platform := range p.Repos[i].Platforms {
+			platforms.Add(platform)
+		}
+		p.Repos[i].Platforms = platforms
+	}
+}
+
+// platformList formats the platforms of a pinned repo for display.
+func platformList(platforms []string) string {
+	if len(platforms) == 0 {
+		return "(all)"
+	}
+	return strings.Join(platforms, ",")
+}
+
+// hashName formats the hash of a pinned repo for display.
+func hashName(hash string) string {
+	if hash == "" {
+		return "(none)"
+	}
+	return hash
+}
+
+// versionName formats the version of a pinned repo for display.
+func versionName(version string) string {
+	if version == "" {
+		return "(none)"
+	}
+	return version
+}
+
+// sourceName formats the source override of a pinned repo for display.
+func sourceName(source string) string {
+	if source == "" {
+		return "(upstream)"
+	}
+	return source
 }
 
 type validationErr struct {
@@ -74,12 +361,51 @@ type validationErr struct {
 }
 
 func (p *Pinlist) validate() error {
-	for _, dep := range p.Deps {
-		if dep.Name == "" {
-			return validationErr{errors.New("bad dep name (empty string)")}
+	roots := make(map[string]bool)
+	for _, repo := range p.Repos {
+		if repo.Root == "" {
+			return validationErr{errors.New("bad repo root (empty string)")}
+		}
+		if roots[repo.Root] {
+			return validationErr{fmt.Errorf("repo %s is listed more than once", repo.Root)}
+		}
+		roots[repo.Root] = true
+		if repo.URL == "" {
+			return validationErr{fmt.Errorf("bad url for repo %s (empty string)", repo.Root)}
+		}
+		switch repo.VCS {
+		case "git", "hg":
+		default:
+			return validationErr{fmt.Errorf("bad vcs for repo %s: %q", repo.Root, repo.VCS)}
+		}
+		if repo.Rev == "" && repo.Version == "" {
+			return validationErr{fmt.Errorf("bad rev for repo %s (empty string, and no version)", repo.Root)}
+		}
+		if repo.Hash != "" && !strings.HasPrefix(repo.Hash, "sha256:") {
+			return validationErr{fmt.Errorf("bad hash for repo %s: %q", repo.Root, repo.Hash)}
 		}
-		if dep.Rev == "" {
-			return validationErr{errors.New("bad rev (empty string)")}
+		if strings.ContainsAny(repo.Version, " \t\n'\"") {
+			return validationErr{fmt.Errorf("bad version for repo %s: %q", repo.Root, repo.Version)}
+		}
+		switch repo.Scope {
+		case "", prodScope, testScope:
+		default:
+			return validationErr{fmt.Errorf("bad scope for repo %s: %q", repo.Root, repo.Scope)}
+		}
+		for _, platform := range repo.Platforms {
+			if _, err := parsePlatform(platform); err != nil {
+				return validationErr{fmt.Errorf("bad platform for repo %s: %q", repo.Root, platform)}
+			}
+		}
+		for _, pkg := range repo.Packages {
+			if !hasPathPrefix(pkg, repo.Root) {
+				return validationErr{fmt.Errorf("package %s is not in repo %s", pkg, repo.Root)}
+			}
+		}
+		for _, pkg := range repo.Explicit {
+			if !hasPathPrefix(pkg, repo.Root) {
+				return validationErr{fmt.Errorf("explicit package %s is not in repo %s", pkg, repo.Root)}
+			}
 		}
 	}
 	return nil
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/build"
+	"os/exec"
+	"strings"
+)
+
+// A platform is a GOOS/GOARCH pair.
+type platform struct {
+	GOOS   string
+	GOARCH string
+}
+
+func (p platform) String() string { return p.GOOS + "/" + p.GOARCH }
+
+func parsePlatform(s string) (platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return platform{}, fmt.Errorf("bad platform %q (must be GOOS/GOARCH)", s)
+	}
+	return platform{parts[0], parts[1]}, nil
+}
+
+// allPlatforms returns every platform supported by the installed Go toolchain.
+func allPlatforms() ([]platform, error) {
+	out, err := exec.Command(goBinary, "tool", "dist", "list").Output()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the platforms supported by Go: %s", err)
+	}
+	var platforms []platform
+	for _, line := range strings.Fields(string(out)) {
+		p, err := parsePlatform(line)
+		if err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, p)
+	}
+	return platforms, nil
+}
+
+// BuildOptions select the build configurations in which glp looks for imports.
+type BuildOptions struct {
+	// Platforms lists the platforms (as GOOS/GOARCH) to consider. If it is empty, every platform supported by
+	// the Go toolchain is used.
+	Platforms []string
+	// Tags lists extra build tags. Files are considered both with and without these tags set.
+	Tags []string
+}
+
+// addBuildFlags registers flags for the options in opts on fs. The defaults come from the config.
+func addBuildFlags(fs *flag.FlagSet, opts *BuildOptions) {
+	*opts = *config.buildOptions()
+	fs.Var((*listFlag)(&opts.Platforms), "platforms",
+		"Comma-separated `GOOS/GOARCH` platforms to find dependencies for (default: all platforms)")
+	fs.Var((*listFlag)(&opts.Tags), "tags", "Comma-separated extra build `tags` to find dependencies for")
+}
+
+// A listFlag is a flag.Value holding a comma-separated list.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// A platformSet is a set of platforms in a buildMatrix, stored as a bitmask of their indexes.
+type platformSet uint64
+
+const maxPlatforms = 64
+
+// A buildMatrix is the set of build configurations that glp considers when finding the imports of a package.
+// For each platform, a package is inspected with and without cgo and with and without the extra build tags;
+// a package's imports are the union of the imports found in every configuration.
+type buildMatrix struct {
+	platforms []platform
+	variants  []buildVariant
+	// host is used for the things that don't depend on the configuration (such as finding stdlib packages).
+	host *build.Context
+}
+
+// A buildVariant is a single configuration in a buildMatrix.
+type buildVariant struct {
+	context  *build.Context
+	platform int // index into buildMatrix.platforms
+}
+
+func newBuildMatrix(gopath string, opts *BuildOptions) (*buildMatrix, error) {
+	var platforms []platform
+	if len(opts.Platforms) == 0 {
+		var err error
+		platforms, err = allPlatforms()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		seen := make(map[platform]bool)
+		for _, s := range opts.Platforms {
+			p, err := parsePlatform(s)
+			if err != nil {
+				return nil, err
+			}
+			if !seen[p] {
+				seen[p] = true
+				platforms = append(platforms, p)
+			}
+		}
+	}
+	if len(platforms) > maxPlatforms {
+		return nil, fmt.Errorf("too many platforms (%d); glp supports at most %d", len(platforms), maxPlatforms)
+	}
+
+	m := &buildMatrix{platforms: platforms}
+	m.host = new(build.Context)
+	*m.host = build.Default
+	m.host.GOPATH = gopath
+	tagSets := [][]string{nil}
+	if len(opts.Tags) > 0 {
+		tagSets = append(tagSets, opts.Tags)
+	}
+	for i, p := range platforms {
+		for _, tags := range tagSets {
+			for _, cgo := range []bool{false, true} {
+				context := new(build.Context)
+				*context = *m.host
+				context.GOOS = p.GOOS
+				context.GOARCH = p.GOARCH
+				context.CgoEnabled = cgo
+				context.BuildTags = tags
+				m.variants = append(m.variants, buildVariant{context, i})
+			}
+		}
+	}
+	return m, nil
+}
+
+// all returns the set of all the platforms in m.
+func (m *buildMatrix) all() platformSet {
+	if len(m.platforms) == maxPlatforms {
+		return ^platformSet(0)
+	}
+	return 1<<uint(len(m.platforms)) - 1
+}
+
+// names returns the names of the platforms in s, or nil if s contains every platform in m.
+func (m *buildMatrix) names(s platformSet) []string {
+	if s == m.all() {
+		return nil
+	}
+	var names smap
+	for i, p := range m.platforms {
+		if s&(1<<uint(i)) != 0 {
+			names.Add(p.String())
+		}
+	}
+	return names
+}
+
+// findImports returns the non-stdlib imports of the package in dir, sorted by import path, considering every
+// configuration in m. If the package imports another in more than one way (say, from both its regular files
+// and its tests), the import is reported with the first applicable kind in the order normal, test, xtest.
+// The platforms of each import are those on which it is imported in any way. If no configuration includes
+// any Go files in dir, a *build.NoGoError is returned.
+func (m *buildMatrix) findImports(dir string) ([]packageImport, error) {
+	pkgs, err := m.importDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	kinds := make(map[string]importKind)
+	platforms := make(map[string]platformSet)
+	add := func(imports []string, kind importKind, platform int) {
+		for _, imp := range imports {
+			if k, ok := kinds[imp]; !ok || kind < k {
+				kinds[imp] = kind
+			}
+			platforms[imp] |= 1 << uint(platform)
+		}
+	}
+	for i, pkg := range pkgs {
+		if pkg == nil {
+			continue
+		}
+		platform := m.variants[i].platform
+		add(pkg.Imports, normalImport, platform)
+		add(pkg.TestImports, testImport, platform)
+		add(pkg.XTestImports, xtestImport, platform)
+	}
+
+	var paths smap
+	for imp := range kinds {
+		if !m.isStd(imp) {
+			paths.Add(imp)
+		}
+	}
+	imports := make([]packageImport, len(paths))
+	for i, path := range paths {
+		imports[i] = packageImport{Path: path, Kind: kinds[path], Platforms: platforms[path]}
+	}
+	return imports, nil
+}
+
+// importDir imports the package in dir in each of the variants of m. The result has the package for each
+// variant, or nil for the variants in which no Go files are included.
+//
+// Most packages have the same files in every variant, so rather than importing the package len(m.variants)
+// times, the variants are grouped by which of the build tags mentioned in dir they satisfy, and the package
+// is imported once per group. The tags in files excluded by their names (such as foo_windows.go) are only
+// seen once a variant including those files has been imported, so grouping is repeated until no new tags
+// turn up.
+func (m *buildMatrix) importDir(dir string) ([]*build.Package, error) {
+	imported := make([]*build.Package, len(m.variants))
+	done := make([]bool, len(m.variants))
+	var tags smap
+	var noGoErr error
+	importVariant := func(i int) (newTags bool, err error) {
+		pkg, err := m.variants[i].context.ImportDir(dir, 0)
+		done[i] = true
+		if err != nil {
+			if _, ok := err.(*build.NoGoError); !ok {
+				return false, err
+			}
+			noGoErr = err
+		} else {
+			imported[i] = pkg
+		}
+		for _, tag := range pkg.AllTags {
+			if !tags.Contains(tag) {
+				tags.Add(tag)
+				newTags = true
+			}
+		}
+		return newTags, nil
+	}
+
+	var groups map[string]int // group key -> index of an imported variant
+	for {
+		groups = make(map[string]int)
+		for i := range m.variants {
+			if done[i] {
+				groups[m.variants[i].key(tags)] = i
+			}
+		}
+		grew := false
+		for i := range m.variants {
+			key := m.variants[i].key(tags)
+			if _, ok := groups[key]; ok {
+				continue
+			}
+			newTags, err := importVariant(i)
+			if err != nil {
+				return nil, err
+			}
+			groups[key] = i
+			grew = grew || newTags
+		}
+		if !grew {
+			break
+		}
+	}
+
+	pkgs := make([]*build.Package, len(m.variants))
+	found := false
+	for i := range m.variants {
+		pkgs[i] = imported[groups[m.variants[i].key(tags)]]
+		found = found || pkgs[i] != nil
+	}
+	if !found {
+		return nil, noGoErr
+	}
+	return pkgs, nil
+}
+
+// key returns a string describing which of tags are satisfied in v.
+func (v buildVariant) key(tags []string) string {
+	b := make([]byte, len(tags))
+	for i, tag := range tags {
+		b[i] = '0'
+		if v.matchTag(tag) {
+			b[i] = '1'
+		}
+	}
+	return string(b)
+}
+
+// unixOS lists the GOOS values that satisfy the "unix" build tag.
+var unixOS = map[string]bool{
+	"aix":       true,
+	"android":   true,
+	"darwin":    true,
+	"dragonfly": true,
+	"freebsd":   true,
+	"hurd":      true,
+	"illumos":   true,
+	"ios":       true,
+	"linux":     true,
+	"netbsd":    true,
+	"openbsd":   true,
+	"solaris":   true,
+}
+
+// matchTag reports whether the build tag is satisfied in v. It follows go/build, but only for the tags that
+// can differ between the variants of a buildMatrix; other tags (such as release tags) are reported as not
+// satisfied, which doesn't matter since they never tell variants apart.
+func (v buildVariant) matchTag(tag string) bool {
+	c := v.context
+	switch tag {
+	case "cgo":
+		return c.CgoEnabled
+	case c.GOOS, c.GOARCH:
+		return true
+	case "unix":
+		return unixOS[c.GOOS]
+	case "linux":
+		return c.GOOS == "android"
+	case "solaris":
+		return c.GOOS == "illumos"
+	case "darwin":
+		return c.GOOS == "ios"
+	}
+	for _, t := range c.BuildTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// isStd reports whether importPath is a stdlib package. Only the location of the package is checked, since
+// some stdlib packages (such as syscall/js) have no files for the host platform.
+func (m *buildMatrix) isStd(importPath string) bool {
+	if importPath == "C" {
+		return true
+	}
+	pkg, err := m.host.Import(importPath, ".", build.FindOnly)
+	return err == nil && pkg.Goroot
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// platformFixture is a package whose imports differ by platform, build tag, and cgo.
+var platformFixture = map[string]string{
+	"a.go": "package foo\n\nimport _ \"example.com/all\"\n",
+	// The amd64 constraint is only seen once a windows variant has been imported.
+	"foo_windows.go": "//go:build amd64\n\npackage foo\n\nimport _ \"example.com/windows\"\n",
+	"integration.go": "//go:build integration\n\npackage foo\n\nimport _ \"example.com/integration\"\n",
+	"cgo_linux.go":   "package foo\n\n// int x;\nimport \"C\"\n\nimport _ \"example.com/cgo\"\n",
+	"foo_test.go":    "package foo\n\nimport (\n\t_ \"example.com/all\"\n\t_ \"example.com/test\"\n)\n",
+	"x_test.go":      "package foo_test\n\nimport (\n\t_ \"example.com/test\"\n\t_ \"example.com/xtest\"\n)\n",
+}
+
+func TestFindImports(t *testing.T) {
+	platforms := []string{"linux/amd64", "windows/amd64", "windows/386"}
+	for _, tt := range []struct {
+		name  string
+		files map[string]string
+		opts  BuildOptions
+		want  []packageImport
+		noGo  bool
+	}{
+		{
+			name:  "tags",
+			files: platformFixture,
+			opts:  BuildOptions{Platforms: platforms, Tags: []string{"integration"}},
+			want: []packageImport{
+				{"example.com/all", normalImport, 0x7},
+				{"example.com/cgo", normalImport, 0x1},
+				{"example.com/integration", normalImport, 0x7},
+				{"example.com/test", testImport, 0x7},
+				{"example.com/windows", normalImport, 0x2},
+				{"example.com/xtest", xtestImport, 0x7},
+			},
+		},
+		{
+			name:  "no tags",
+			files: platformFixture,
+			opts:  BuildOptions{Platforms: platforms},
+			want: []packageImport{
+				{"example.com/all", normalImport, 0x7},
+				{"example.com/cgo", normalImport, 0x1},
+				{"example.com/test", testImport, 0x7},
+				{"example.com/windows", normalImport, 0x2},
+				{"example.com/xtest", xtestImport, 0x7},
+			},
+		},
+		{
+			name:  "one platform",
+			files: platformFixture,
+			opts:  BuildOptions{Platforms: []string{"windows/386"}},
+			want: []packageImport{
+				{"example.com/all", normalImport, 0x1},
+				{"example.com/test", testImport, 0x1},
+				{"example.com/xtest", xtestImport, 0x1},
+			},
+		},
+		{
+			name:  "no go files",
+			files: map[string]string{"foo_windows.go": platformFixture["foo_windows.go"]},
+			opts:  BuildOptions{Platforms: []string{"linux/amd64", "windows/386"}},
+			noGo:  true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "glp-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for name, contents := range tt.files {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			m, err := newBuildMatrix("", &tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// importDir must agree with importing the package in every variant.
+			pkgs, err := m.importDir(dir)
+			if tt.noGo {
+				if _, ok := err.(*build.NoGoError); !ok {
+					t.Fatalf("importDir: got error %v; want a *build.NoGoError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("importDir: %s", err)
+			}
+			for i, v := range m.variants {
+				want, err := v.context.ImportDir(dir, 0)
+				if err != nil {
+					want = nil
+				}
+				got := pkgs[i]
+				if (got == nil) != (want == nil) || got != nil && (!reflect.DeepEqual(got.Imports, want.Imports) ||
+					!reflect.DeepEqual(got.TestImports, want.TestImports) ||
+					!reflect.DeepEqual(got.XTestImports, want.XTestImports)) {
+					t.Errorf("importDir: variant %d (%s, cgo=%t, tags=%q) doesn't match importing it directly",
+						i, m.platforms[v.platform], v.context.CgoEnabled, v.context.BuildTags)
+				}
+			}
+
+			got, err := m.findImports(dir)
+			if err != nil {
+				t.Fatalf("findImports: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findImports: got\n\t%v\nwant\n\t%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchTag(t *testing.T) {
+	for _, tt := range []struct {
+		goos, goarch string
+		cgo          bool
+		tags         []string
+		tag          string
+		want         bool
+	}{
+		{"linux", "amd64", false, nil, "linux", true},
+		{"linux", "amd64", false, nil, "amd64", true},
+		{"linux", "amd64", false, nil, "windows", false},
+		{"linux", "amd64", false, nil, "386", false},
+		{"linux", "amd64", false, nil, "unix", true},
+		{"windows", "amd64", false, nil, "unix", false},
+		{"linux", "amd64", false, nil, "cgo", false},
+		{"linux", "amd64", true, nil, "cgo", true},
+		{"android", "arm64", false, nil, "linux", true},
+		{"android", "arm64", false, nil, "unix", true},
+		{"illumos", "amd64", false, nil, "solaris", true},
+		{"solaris", "amd64", false, nil, "illumos", false},
+		{"ios", "arm64", false, nil, "darwin", true},
+		{"darwin", "arm64", false, nil, "ios", false},
+		{"linux", "amd64", false, []string{"integration"}, "integration", true},
+		{"linux", "amd64", false, nil, "integration", false},
+		{"linux", "amd64", false, nil, "go1.1", false},
+	} {
+		context := build.Default
+		context.GOOS, context.GOARCH, context.CgoEnabled, context.BuildTags = tt.goos, tt.goarch, tt.cgo, tt.tags
+		v := buildVariant{context: &context}
+		if got := v.matchTag(tt.tag); got != tt.want {
+			t.Errorf("matchTag(%q) on %s/%s (cgo=%t, tags=%q): got %t; want %t",
+				tt.tag, tt.goos, tt.goarch, tt.cgo, tt.tags, got, tt.want)
+		}
+	}
+}
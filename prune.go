@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func runPrune(root string, args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	force := fs.Bool("force", false, "Remove orphaned repos without asking for confirmation")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	return Prune(root, *force)
+}
+
+// Prune removes repos from the cache that are not used by any dep in the pinlist. Unless force is true, it
+// lists the repos and asks for confirmation first.
+func Prune(root string, force bool) error {
+	pinlistFilename := filepath.Join(root, projectDirName, pinlistName)
+	pinlist, err := LoadPinlist(pinlistFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("No pinlist file (looked for %s). Try running 'glp sync'.", pinlistFilename)
+		}
+		return err
+	}
+	report, err := Verify(root, pinlist)
+	if err != nil {
+		return err
+	}
+	if len(report.Orphaned) == 0 {
+		textf("No cached repos to remove.\n")
+		return nil
+	}
+
+	textf("Cached repos not in the pinlist:\n")
+	for _, repo := range report.Orphaned {
+		logEvent("repo-orphaned", eventFields{"repo": repo}, "\t%s\n", repo)
+	}
+	if !force {
+		// In JSON mode, stdout is reserved for events, so prompt on stderr.
+		prompt := os.Stdout
+		if jsonMode {
+			prompt = os.Stderr
+		}
+		fmt.Fprint(prompt, "Remove these repos? [y/N] ")
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			answer = ""
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+		default:
+			textf("Not removing anything.\n")
+			return nil
+		}
+	}
+
+	cache := config.cacheSrcDir(root)
+	for _, repo := range report.Orphaned {
+		logEvent("repo-removed", eventFields{"repo": repo}, "Removing cached repo %s\n", repo)
+		if err := os.RemoveAll(filepath.Join(cache, repo)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
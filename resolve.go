@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// A resolver walks the transitive dependencies of a set of packages, syncing the repo containing each
+// dependency into the cache. Packages are processed concurrently, with at most jobs packages being worked on
+// at any one time. Each repo is synced exactly once (by whichever worker first encounters one of its
+// packages), so every package from a repo ends up at the same rev.
+//
+// The resolver also works out how each dependency is needed (see depNeed): a package is in prodScope if the
+// project's non-test code needs it, and in testScope if it is only needed by tests, and it is needed on the
+// platforms of the matrix where some chain of imports from the project reaches it. The imports of
+// dependencies' own tests are only followed if withDepTests is set.
+type resolver struct {
+	matrix       *buildMatrix
+	cacheDir     string
+	pinlist      *Pinlist
+	manifest     Manifest
+	withDepTests bool
+	sem          chan struct{}
+	wg           sync.WaitGroup
+
+	mu    sync.Mutex
+	needs map[string]depNeed         // packages seen so far
+	deps  map[string][]packageImport // the imports of each package, once processed
+	repos map[string]*resolvedRepo
+	err   error
+}
+
+// A resolvedRepo is the result of syncing a single repo.
+type resolvedRepo struct {
+	once   sync.Once
+	repo   *RepoRoot
+	pinned *PinnedRepo
+	err    error
+}
+
+// A depNeed says how a package is needed by the project: in which scope, and on which platforms.
+type depNeed struct {
+	Scope     depScope
+	Platforms platformSet
+}
+
+// merge returns the need for a package that is needed both as n and as other.
+func (n depNeed) merge(other depNeed) depNeed {
+	if other.Scope == prodScope {
+		n.Scope = prodScope
+	}
+	n.Platforms |= other.Platforms
+	return n
+}
+
+func newResolver(matrix *buildMatrix, cacheDir string, pinlist *Pinlist, manifest Manifest,
+	opts *SyncOptions) *resolver {
+
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	return &resolver{
+		matrix:       matrix,
+		cacheDir:     cacheDir,
+		pinlist:      pinlist,
+		manifest:     manifest,
+		withDepTests: opts.WithDepTests,
+		sem:          make(chan struct{}, jobs),
+		needs:        make(map[string]depNeed),
+		deps:         make(map[string][]packageImport),
+		repos:        make(map[string]*resolvedRepo),
+	}
+}
+
+// resolve syncs the repos for deps (which map import paths to how they are needed) and all of their
+// transitive dependencies. It returns the resulting pinned repos (in no particular order), with their
+// packages, scopes, and platforms filled in.
+func (r *resolver) resolve(deps map[string]depNeed) ([]*PinnedRepo, error) {
+	for dep, need := range deps {
+		r.add(dep, need)
+	}
+	r.wg.Wait()
+	if r.err != nil {
+		return nil, r.err
+	}
+	var pinned []*PinnedRepo
+	for _, resolved := range r.repos {
+		need := depNeed{Scope: testScope}
+		for _, pkg := range resolved.pinned.Packages {
+			need = need.merge(r.needs[pkg])
+		}
+		resolved.pinned.Scope = need.Scope
+		resolved.pinned.Platforms = r.matrix.names(need.Platforms)
+		pinned = append(pinned, resolved.pinned)
+	}
+	return pinned, nil
+}
+
+// add schedules importPath to be processed with the given need, if it hasn't been already. If importPath has
+// already been seen, its need is merged with the existing one; if that widens it (from testScope to
+// prodScope, or to more platforms), the need of its dependencies is widened as well.
+func (r *resolver) add(importPath string, need depNeed) {
+	r.mu.Lock()
+	if r.err != nil {
+		r.mu.Unlock()
+		return
+	}
+	oldNeed, seen := r.needs[importPath]
+	if seen {
+		need = oldNeed.merge(need)
+		if need == oldNeed {
+			r.mu.Unlock()
+			return
+		}
+		r.needs[importPath] = need
+		// If the package is still being processed, process will pick up the new need when it adds the
+		// dependencies.
+		deps, processed := r.deps[importPath]
+		r.mu.Unlock()
+		if processed {
+			r.addDeps(deps, need)
+		}
+		return
+	}
+	r.needs[importPath] = need
+	r.wg.Add(1)
+	r.mu.Unlock()
+
+	go func() {
+		defer r.wg.Done()
+		r.sem <- struct{}{}
+		err := r.process(importPath)
+		<-r.sem
+		if err != nil {
+			r.fail(err)
+		}
+	}()
+}
+
+// addDeps adds the imports deps of a package that is needed as need. Imports that are only made on platforms
+// where the package isn't needed are skipped.
+func (r *resolver) addDeps(deps []packageImport, need depNeed) {
+	for _, dep := range deps {
+		child := depNeed{Scope: need.Scope, Platforms: need.Platforms & dep.Platforms}
+		if child.Platforms == 0 {
+			continue
+		}
+		if dep.Kind != normalImport {
+			child.Scope = testScope
+		}
+		r.add(dep.Path, child)
+	}
+}
+
+// fail records err as the result of the resolution, unless an error has already occurred.
+func (r *resolver) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *resolver) failed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err != nil
+}
+
+// process syncs the repo containing importPath and then schedules the package's own dependencies.
+func (r *resolver) process(importPath string) error {
+	if r.failed() {
+		return nil
+	}
+	repo, err := r.pinlist.RepoRootForImportPath(importPath, r.cacheDir)
+	if err != nil {
+		return err
+	}
+	resolved, err := r.syncRepo(repo)
+	if err != nil {
+		return err
+	}
+
+	// Add the dependencies of this package to the to-process list if they haven't already been inspected
+	deps, err := findDeps(r.matrix, filepath.Join(r.cacheDir, importPath), r.withDepTests)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	resolved.pinned.Packages = append(resolved.pinned.Packages, importPath)
+	r.deps[importPath] = deps
+	need := r.needs[importPath]
+	r.mu.Unlock()
+	r.addDeps(deps, need)
+	return nil
+}
+
+// syncRepo syncs repo into the cache if that hasn't been done yet and returns the result.
+func (r *resolver) syncRepo(repo *RepoRoot) (*resolvedRepo, error) {
+	r.mu.Lock()
+	resolved, ok := r.repos[repo.Root]
+	if !ok {
+		resolved = &resolvedRepo{repo: repo}
+		r.repos[repo.Root] = resolved
+	}
+	r.mu.Unlock()
+
+	resolved.once.Do(func() {
+		resolved.pinned, resolved.err = syncRepo(repo, r.cacheDir, r.pinlist.Find(repo.Root), r.manifest)
+	})
+	if resolved.err != nil {
+		return nil, resolved.err
+	}
+	// Two packages that map to the same repo root must agree on where that repo comes from.
+	if repo.fetchURL() != resolved.repo.fetchURL() || repo.VCS.Cmd != resolved.repo.VCS.Cmd {
+		return nil, fmt.Errorf("Multiple packages with conflicting sources (%s and %s) map to the repo %s",
+			resolved.repo.fetchURL(), repo.fetchURL(), repo.Root)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// Status prints a summary of the project located at root: its GOPATH, the state of each pinned repo in the
+// cache (or the directory it is linked to), the repos that are fetched from a source override, any cached
+// repos that aren't pinned, and any project imports that aren't pinned. It doesn't modify anything: hashes
+// are checked without writing hash stamps (see hashRepo), and git repos are checked for changes without
+// refreshing their index. (Mercurial may still update the cached file times in a repo's dirstate.)
+func Status(root, gopath string) error {
+	logEvent("project", eventFields{"root": root, "gopath": gopath},
+		"Project root: %s\nGOPATH: %s\n", root, gopath)
+
+	pinlistFilename := filepath.Join(root, projectDirName, pinlistName)
+	pinlist, err := LoadPinlist(pinlistFilename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		logEvent("no-pinlist", eventFields{"pinlist": pinlistFilename},
+			"No pinlist file (looked for %s).\n", pinlistFilename)
+		pinlist = new(Pinlist)
+	}
+	report, err := verifyCache(root, pinlist)
+	if err != nil {
+		return err
+	}
+	if err := report.checkHashes(root, hashReadOnly); err != nil {
+		return err
+	}
+
+	textf("\n")
+	switch {
+	case jsonMode:
+		for _, status := range report.Repos {
+			fields := eventFields{
+				"repo":       status.Repo.Root,
+				"rev":        status.Repo.Rev,
+				"cached":     status.Cached,
+				"cached_rev": status.CachedRev,
+				"dirty":      status.Dirty,
+			}
+			if status.Dirty {
+				fields["dirty_files"] = status.DirtyFiles
+			}
+			if status.Repo.Version != "" {
+				fields["version"] = status.Repo.Version
+			}
+			if status.Repo.Source != "" {
+				fields["source"] = status.Repo.Source
+			}
+			if status.Link != "" {
+				fields["link"] = status.Link
+			}
+			logEvent("repo-status", fields, "")
+		}
+	case len(report.Repos) == 0:
+		fmt.Println("No pinned repos.")
+	default:
+		fmt.Println("Pinned repos:")
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "\tREPO\tVERSION\tPINNED REV\tCACHED REV\tDIRTY")
+		for _, status := range report.Repos {
+			cachedRev := "(not cached)"
+			dirty := "-"
+			switch {
+			case status.Link != "":
+				cachedRev = "(linked to " + status.Link + ")"
+			case status.Cached:
+				cachedRev = status.CachedRev
+				if cachedRev == status.Repo.Rev {
+					cachedRev = "(same)"
+				}
+				dirty = "no"
+				if status.Dirty {
+					dirty = fmt.Sprintf("yes (%d files; see 'glp verify')", len(status.DirtyFiles))
+				}
+			}
+			version := status.Repo.Version
+			if version == "" {
+				version = "-"
+			}
+			pinnedRev := status.Repo.Rev
+			if pinnedRev == "" {
+				pinnedRev = "(unresolved)"
+			}
+			fmt.Fprintf(w, "\t%s\t%s\t%s\t%s\t%s\n", status.Repo.Root, version, pinnedRev, cachedRev, dirty)
+		}
+		w.Flush()
+
+		var overridden []PinnedRepo
+		for _, status := range report.Repos {
+			if status.Repo.Source != "" {
+				overridden = append(overridden, status.Repo)
+			}
+		}
+		if len(overridden) > 0 {
+			fmt.Println("\nRepos fetched from a source override instead of upstream:")
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "\tREPO\tSOURCE\tUPSTREAM")
+			for _, repo := range overridden {
+				fmt.Fprintf(w, "\t%s\t%s\t%s\n", repo.Root, repo.Source, repo.URL)
+			}
+			w.Flush()
+		}
+	}
+
+	textf("\n")
+	if len(report.Orphaned) == 0 {
+		textf("No cached repos outside the pinlist.\n")
+	} else {
+		textf("Cached repos not in the pinlist (remove them with 'glp prune'):\n")
+		for _, repo := range report.Orphaned {
+			logEvent("repo-orphaned", eventFields{"repo": repo}, "\t%s\n", repo)
+		}
+	}
+
+	matrix, err := newBuildMatrix(gopath, config.buildOptions())
+	if err != nil {
+		return err
+	}
+	immediateDeps, _, _, err := findProjectDeps(matrix, root)
+	if err != nil {
+		return err
+	}
+	var deps smap
+	for dep := range immediateDeps {
+		deps.Add(dep)
+	}
+	var unpinned []string
+	for _, dep := range deps {
+		pinned := pinlist.FindPackage(dep)
+		if pinned == nil {
+			unpinned = append(unpinned, dep)
+			continue
+		}
+		if packages := smap(pinned.Packages); !packages.Contains(dep) {
+			unpinned = append(unpinned, dep)
+		}
+	}
+	textf("\n")
+	if len(unpinned) == 0 {
+		textf("All project imports are pinned.\n")
+	} else {
+		textf("Project imports not in the pinlist (run 'glp sync' to add them):\n")
+		for _, dep := range unpinned {
+			logEvent("import-unpinned", eventFields{"package": dep}, "\t%s\n", dep)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The shared repo store is an optional, machine-wide set of repos (in $GLP_HOME/repos) that is shared by all
+// glp projects. When it is enabled, dependency repos are only fetched from upstream into the store, and each
+// project's cache is populated from the store: git checkouts borrow the store's objects (via
+// 'git clone --shared') and hg checkouts are hardlinked clones.
+//
+// Because git checkouts don't have their own copies of the objects, the store must never lose a commit that a
+// checkout is on, even if upstream deletes or rewrites the branch it was on. So git stores are fetched without
+// --prune, never garbage collected automatically (gc.auto=0), and keep a ref (refs/glp/keep/<rev>) for every
+// revision that a project checks out. (hg never loses commits on pull.) Each repo in the store is locked while
+// it is being updated or copied, since several projects may be syncing at once.
+
+var glpHome = os.Getenv("GLP_HOME")
+
+// sharedStoreDir returns the location in the shared repo store of the repo with the given root, or "" if the
+// store is not enabled.
+func sharedStoreDir(root string) string {
+	if glpHome == "" {
+		return ""
+	}
+	return filepath.Join(glpHome, "repos", root)
+}
+
+// lockStore locks the store copy of the repo, waiting for any other glp process that has it locked. The
+// returned function releases the lock.
+func (v VCSCmd) lockStore() (unlock func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(v.store), 0777); err != nil {
+		return nil, err
+	}
+	return lockFile(v.store + ".lock")
+}
+
+// updateStore creates the store copy of repo, or fetches the latest changes into it if it already exists. In
+// offline mode, the store copy is used as-is. The store must be locked.
+func (v VCSCmd) updateStore(repo string) error {
+	if _, err := os.Stat(v.store); err == nil {
+		if offlineMode {
+			return nil
+		}
+		switch v.Cmd.Cmd {
+		case "git":
+			// Stores created by older versions of glp may not have gc disabled yet.
+			if err := v.run(v.store, "config gc.auto 0"); err != nil {
+				return err
+			}
+			return v.run(v.store, "fetch")
+		case "hg":
+			return v.run(v.store, "pull")
+		}
+		return fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if offlineMode {
+		return errOffline
+	}
+	parent := filepath.Dir(v.store)
+	if err := os.MkdirAll(parent, 0777); err != nil {
+		return err
+	}
+	switch v.Cmd.Cmd {
+	case "git":
+		if err := v.runArgs(parent, "clone", "--mirror", repo, v.store); err != nil {
+			return err
+		}
+		return v.run(v.store, "config gc.auto 0")
+	case "hg":
+		return v.runArgs(parent, "clone", "-U", repo, v.store)
+	}
+	return fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+}
+
+// createFromStore creates a copy of repo in dir from the shared store.
+func (v VCSCmd) createFromStore(dir, repo string) error {
+	unlock, err := v.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := v.updateStore(repo); err != nil {
+		return err
+	}
+	parent := filepath.Dir(dir)
+	if err := os.MkdirAll(parent, 0777); err != nil {
+		return err
+	}
+	switch v.Cmd.Cmd {
+	case "git":
+		if err := v.runArgs(parent, "clone", "--shared", v.store, dir); err != nil {
+			return err
+		}
+	case "hg":
+		// Local hg clones hardlink the repository data.
+		if err := v.runArgs(parent, "clone", "-U", v.store, dir); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+	}
+	if err := v.keepRev(dir); err != nil {
+		return err
+	}
+	// Point the checkout back at upstream so that it looks like a normal clone.
+	return v.setUpstreamURL(dir, repo)
+}
+
+// fetchFromStore fetches the latest upstream changes into the store and then copies them into the repo in dir.
+func (v VCSCmd) fetchFromStore(dir string) error {
+	repo, err := v.upstreamURL(dir)
+	if err != nil {
+		return err
+	}
+	unlock, err := v.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := v.updateStore(repo); err != nil {
+		return err
+	}
+	switch v.Cmd.Cmd {
+	case "git":
+		return v.runArgs(dir, "fetch", "--tags", v.store, "+refs/heads/*:refs/remotes/origin/*")
+	case "hg":
+		return v.runArgs(dir, "pull", v.store)
+	}
+	return fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+}
+
+// keepInStore makes sure that the store keeps the revision that the repo in dir (a checkout made from the store)
+// is on, even once upstream no longer has it.
+func (v VCSCmd) keepInStore(dir string) error {
+	if v.store == "" || v.Cmd.Cmd != "git" {
+		return nil
+	}
+	unlock, err := v.lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return v.keepRev(dir)
+}
+
+// keepRev is keepInStore for a store that is already locked.
+func (v VCSCmd) keepRev(dir string) error {
+	if v.Cmd.Cmd != "git" {
+		return nil
+	}
+	out, err := v.runOutput(dir, "rev-parse HEAD")
+	if err != nil {
+		return err
+	}
+	rev := strings.TrimSpace(string(out))
+	return v.runArgs(v.store, "update-ref", "refs/glp/keep/"+rev, rev)
+}
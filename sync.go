@@ -1,14 +1,58 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"go/build"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
+// SyncOptions control the behavior of Sync.
+type SyncOptions struct {
+	BuildOptions
+	// Jobs is the maximum number of dependencies to fetch and inspect concurrently.
+	Jobs int
+	// Frozen means that the pinlist must not change: instead of saving the new pinlist, Sync fails with a
+	// description of the differences.
+	Frozen bool
+	// WithDepTests means that the test imports of dependencies are followed (and pinned, in testScope).
+	// The test imports of the project's own packages are always followed.
+	WithDepTests bool
+	// Verbose means that the directories skipped when looking for project packages are reported.
+	Verbose bool
+}
+
+const defaultSyncJobs = 4
+
+// addSyncFlags registers flags for the options in opts on fs.
+func addSyncFlags(fs *flag.FlagSet, opts *SyncOptions) {
+	fs.IntVar(&opts.Jobs, "j", defaultSyncJobs, "Fetch up to `N` dependency repos in parallel")
+	fs.BoolVar(&opts.WithDepTests, "with-dep-tests", false, "Also pin the test dependencies of dependencies")
+	fs.BoolVar(&opts.Verbose, "v", false, "Report the directories skipped when looking for project packages")
+	addBuildFlags(fs, &opts.BuildOptions)
+}
+
+func runSync(root, gopath string, args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	opts := new(SyncOptions)
+	addSyncFlags(fs, opts)
+	fs.BoolVar(&opts.Frozen, "frozen", frozenMode, "Fail instead of changing glp/deps.json")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments to sync: %v", args)
+	}
+	return Sync(root, gopath, opts)
+}
+
 // Sync synchronizes the state of the project code (what dependencies it has), the pinlist, and all
-// (transitive) dependencies in the cache.
+// (transitive) dependencies in the cache. Dependencies are processed concurrently (see resolver).
 //   * First, analyze the project code to get a list of its dependencies
 //   * For each dependency, update the cache/dependency list:
 //     - If the dependency is not cached, pull down the rev specifed (or latest if dep not in the pinlist)
@@ -18,208 +62,457 @@ import (
 //		 - Add the dep's transitive non-stdlib deps to the dependency list to be processed (if not done already)
 //		* Recreate the pinlist from the set of deps and versions in the updated dependency list (this will also
 //			have the effect of removing outdated dependencies)
-//		* Write out the new pinlist
-func Sync(root, gopath string) error {
-	// Make a map out of the current pinlist
-	pinnedVersions, err := makePinMap(root)
+//		* Write out the new pinlist, and the manifest of the files in each repo (see Manifest)
+func Sync(root, gopath string, opts *SyncOptions) error {
+	pinlist, err := loadPinlistIfExists(root)
 	if err != nil {
 		return err
 	}
 
-	// Get the list of immediate dependencies from the code
-	context := new(build.Context)
-	*context = build.Default
-	context.GOPATH = gopath
-
-	immediateDeps, projectPackages, err := findProjectDeps(context, root)
+	// Get the list of immediate dependencies from the code, for every platform we care about.
+	matrix, err := newBuildMatrix(gopath, &opts.BuildOptions)
+	if err != nil {
+		return err
+	}
+	immediateDeps, projectPackages, skipped, err := findProjectDeps(matrix, root)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Found project packages:")
+	textf("Found project packages:\n")
 	for _, pkg := range projectPackages {
-		fmt.Printf("\t%s\n", pkg)
-	}
-
-	// Now sync each dependency, adding transitive deps to the to-process list as we go.
-	var processedDeps smap
-	toProcessDeps := immediateDeps
-	// Multiple packages may map to the same repo, and thus must necessarily must be at the same rev. We will
-	// fill in the following two mappings as we go and fail if there's a contradiction.
-	pinnedVersionsByRepo := make(map[string]string)
-	packageToRepo := make(map[string]string)
-	cacheDir := filepath.Join(root, projectDirName, cacheDirName, "src")
-	for len(toProcessDeps) > 0 {
-		importPath := toProcessDeps[0]
-		toProcessDeps.Remove(importPath)
-		repo, err := RepoRootForImportPath(importPath, false)
-		if err != nil {
-			return err
+		logEvent("project-package", eventFields{"package": pkg}, "\t%s\n", pkg)
+	}
+	if opts.Verbose && len(skipped) > 0 {
+		textf("Skipped directories:\n")
+		for _, s := range skipped {
+			logEvent("dir-skipped", eventFields{"dir": s.Dir, "reason": s.Reason}, "\t%s (%s)\n", s.Dir, s.Reason)
 		}
-		switch repo.VCS.Cmd.Cmd {
-		case "git", "hg":
-		default:
-			return fmt.Errorf("%s is not a VCS supported by glp", repo.VCS.Cmd.Name)
-		}
-		packageToRepo[importPath] = repo.Root
-		rev, pinned := pinnedVersions[importPath]
-		if pinned {
-			rev2, ok := pinnedVersionsByRepo[repo.Root]
-			if ok && rev != rev2 {
-				return fmt.Errorf("Multiple packages with conflicting revs map to the repo %s", repo.Root)
-			}
+	}
+
+	// Packages added with 'glp add' stay pinned whether or not the project imports them.
+	for _, repo := range pinlist.Repos {
+		for _, pkg := range repo.Explicit {
+			immediateDeps[pkg] = immediateDeps[pkg].merge(depNeed{Scope: prodScope, Platforms: matrix.all()})
 		}
+	}
 
-		// Check if the repo is already cached at all.
-		repoDir := filepath.Join(cacheDir, repo.Root)
-		if _, err := os.Stat(repoDir); err != nil {
-			if !os.IsNotExist(err) {
-				return err
-			}
-			// Repo hasn't been downloaded; fetch latest
-			fmt.Printf("Dep repo %s does not exist; downloading...", repo.Root)
-			if err := repo.VCS.Create(repoDir, repo.Repo); err != nil {
-				return err
+	// Now sync each dependency, adding transitive deps as we go.
+	manifest, err := loadManifest(root)
+	if err != nil {
+		return err
+	}
+	cacheDir := config.cacheSrcDir(root)
+	syncedRepos, err := newResolver(matrix, cacheDir, pinlist, manifest, opts).resolve(immediateDeps)
+	if err != nil {
+		return err
+	}
+	logEvent("synced", eventFields{"repos": len(syncedRepos)}, "Dependencies are up-to-date.\n")
+
+	// Now write out the updated pin list. We reconstruct it from the synced repos because the old pinlist may
+	// contain outdated deps that are not needed by the current project code.
+	pinlistFilename := filepath.Join(root, projectDirName, pinlistName)
+	newPinlist := new(Pinlist)
+	for _, synced := range syncedRepos {
+		newPinlist.Repos = append(newPinlist.Repos, *synced)
+	}
+	if opts.Frozen {
+		// Hashes are checked but not added in frozen mode, so that pinlists from before hashes were recorded
+		// don't need rewriting.
+		for i := range newPinlist.Repos {
+			if old := pinlist.Find(newPinlist.Repos[i].Root); old != nil && old.Hash == "" {
+				newPinlist.Repos[i].Hash = ""
 			}
-			fmt.Println("done.")
 		}
-
-		// Get the state of the repo (current rev and whether it's dirty)
-		currentRev, dirty, err := repo.VCS.GetRev(repoDir)
-		if err != nil {
-			return err
+		return checkFrozen(pinlistFilename, pinlist, newPinlist)
+	}
+	for _, repo := range newPinlist.Repos {
+		if pinlist.Find(repo.Root) == nil {
+			logEvent("dep-added",
+				eventFields{
+					"repo":      repo.Root,
+					"rev":       repo.Rev,
+					"scope":     repo.Scope,
+					"platforms": repo.Platforms,
+					"packages":  repo.Packages,
+				},
+				"Added dep repo %s at rev %s (%s)\n", repo.Root, repo.Rev, describeNeed(&repo))
 		}
-		if dirty {
-			return fmt.Errorf("dep repo at %s is currently dirty (has untracked changes)", repoDir)
+	}
+	for _, repo := range pinlist.Repos {
+		if newPinlist.Find(repo.Root) == nil {
+			logEvent("dep-removed", eventFields{"repo": repo.Root, "rev": repo.Rev},
+				"Removed dep repo %s (no longer used)\n", repo.Root)
 		}
-		if pinned && currentRev != rev {
-			// If the repo is does not matched the pinned version, update to that version
-			fmt.Printf("Updating dep repo at %s to rev %s\n", repoDir, rev)
-			if err := repo.VCS.UpdateRev(repoDir, rev); err != nil {
+	}
+	if err := newPinlist.Save(pinlistFilename); err != nil {
+		return err
+	}
+	return saveManifest(root, newPinlist, manifest)
+}
+
+// saveManifest writes the manifest of the project located at root for the repos in pinlist, which are
+// cached at their pinned revs. The files of each repo are kept from the old manifest if they match its pinned
+// hash, or else read from the cache.
+func saveManifest(root string, pinlist *Pinlist, old Manifest) error {
+	manifest := make(Manifest)
+	for i := range pinlist.Repos {
+		repo := &pinlist.Repos[i]
+		if repo.Hash == "" {
+			continue
+		}
+		files := old.files(repo)
+		if files == nil {
+			dir := filepath.Join(config.cacheSrcDir(root), repo.Root)
+			var err error
+			if files, err = repo.RepoRoot().VCS.CommittedFiles(dir, repo.Rev); err != nil {
 				return err
 			}
+			if hashFiles(files) != repo.Hash {
+				return fmt.Errorf("the files of dep repo %s changed while syncing", repo.Root)
+			}
 		}
-		if !pinned {
-			rev = currentRev
-		}
+		manifest[repo.Root] = files
+	}
+	return manifest.Save(filepath.Join(root, projectDirName, manifestName))
+}
 
-		// Update the pin list -- these are possibly no-ops
-		pinnedVersions[importPath] = rev
-		pinnedVersionsByRepo[repo.Root] = rev
+// describeNeed formats the scope and (if restricted) platforms of repo for display.
+func describeNeed(repo *PinnedRepo) string {
+	if len(repo.Platforms) == 0 {
+		return string(repo.Scope)
+	}
+	return fmt.Sprintf("%s; %s only", repo.Scope, strings.Join(repo.Platforms, ","))
+}
 
-		// Add the dependencies of this package to the to-process list if they haven't already been inspected
-		packageDir := filepath.Join(cacheDir, importPath)
-		deps, err := findDeps(context, packageDir)
-		if err != nil {
-			return err
+// checkFrozen returns an error describing the differences if saving newPinlist to filename (where pinlist was
+// loaded from) would change it.
+func checkFrozen(filename string, pinlist, newPinlist *Pinlist) error {
+	newPinlist.normalize()
+	if diffs := pinlist.Diff(newPinlist); len(diffs) > 0 {
+		return fmt.Errorf("%s is out of date (sync would make these changes):\n\t%s",
+			filename, strings.Join(diffs, "\n\t"))
+	}
+	saved, err := newPinlist.IsSavedAs(filename)
+	if err != nil {
+		return err
+	}
+	if !saved {
+		return fmt.Errorf("%s is not in normalized form (run 'glp sync' to rewrite it)", filename)
+	}
+	return nil
+}
+
+// syncRepo makes sure that repo is present in the cache at the rev given by pinned (or at the latest rev, if
+// pinned is nil). If pinned has a version but no rev yet, the rev is the one that the tag or branch names. A
+// pinned rev that disagrees with its tag (because the tag was moved upstream) is an error rather than being
+// repinned. It returns the pinned state of the repo, without any packages filled in.
+func syncRepo(repo *RepoRoot, cacheDir string, pinned *PinnedRepo, manifest Manifest) (*PinnedRepo, error) {
+	switch repo.VCS.Cmd.Cmd {
+	case "git", "hg":
+	default:
+		return nil, fmt.Errorf("%s is not a VCS supported by glp", repo.VCS.Cmd.Name)
+	}
+
+	// Check if the repo is already cached at all.
+	repoDir := filepath.Join(cacheDir, repo.Root)
+	if _, err := os.Stat(repoDir); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
 		}
-		for _, dep := range deps {
-			if !processedDeps.Contains(dep) {
-				toProcessDeps.Add(dep)
+		// Repo hasn't been downloaded; fetch latest
+		textf("Dep repo %s does not exist; downloading...\n", repo.Root)
+		if err := repo.VCS.Create(repoDir, repo.fetchURL()); err != nil {
+			if err == errOffline {
+				return nil, fmt.Errorf("dep repo %s is not cached and cannot be downloaded in offline mode",
+					repo.Root)
 			}
+			return nil, err
 		}
-
-		processedDeps.Add(importPath)
+		logEvent("repo-fetched",
+			eventFields{"repo": repo.Root, "url": repo.fetchURL(), "vcs": repo.VCS.Cmd.Cmd}, "")
+	} else if err := repo.pointAtSource(repoDir); err != nil {
+		return nil, err
 	}
-	fmt.Println("Dependencies are up-to-date.")
 
-	// Now write out the updated pin list. We reconstruct from pinnedVersionsByRepo and packageToRepo becaused
-	// pinnedVersions may contain outdated deps that are not needed by the current project code.
-	pinlistFilename := filepath.Join(root, projectDirName, pinlistName)
-	newPinlist := new(Pinlist)
-	var deps smap
-	for dep := range packageToRepo {
-		deps.Add(dep)
+	// Get the state of the repo (current rev and whether it's dirty)
+	currentRev, dirty, err := repo.VCS.GetRev(repoDir)
+	if err != nil {
+		return nil, err
 	}
-	for _, dep := range deps {
-		newPinlist.Deps = append(newPinlist.Deps, Dep{
-			Name: dep,
-			Rev:  pinnedVersionsByRepo[packageToRepo[dep]],
-		})
+	if len(dirty) > 0 {
+		return nil, fmt.Errorf("dep repo at %s is currently dirty:%s", repoDir, fileList(dirty))
 	}
-	return newPinlist.Save(pinlistFilename)
+	rev := currentRev
+	version := ""
+	if pinned != nil {
+		rev = pinned.Rev
+		version = pinned.Version
+		if version != "" {
+			versionRev, branch, err := repo.VCS.ResolveVersion(repoDir, version)
+			if err != nil {
+				if err == errOffline {
+					return nil, fmt.Errorf("version %s of dep repo %s is not cached and cannot be fetched in "+
+						"offline mode", version, repo.Root)
+				}
+				return nil, fmt.Errorf("cannot resolve version %s of dep repo %s: %s", version, repo.Root, err)
+			}
+			switch {
+			case rev == "":
+				logEvent("version-resolved", eventFields{"repo": repo.Root, "version": version, "rev": versionRev},
+					"Dep repo %s version %s is rev %s\n", repo.Root, version, versionRev)
+				rev = versionRev
+			case !branch && rev != versionRev:
+				// The pinned rev is what gets built, so a tag that was moved upstream must not silently change
+				// it.
+				return nil, fmt.Errorf("dep repo %s is pinned at rev %s, but its version %s is rev %s (was the "+
+					"tag moved?); run 'glp update %s --version %s' to pin the tag's current rev",
+					repo.Root, rev, version, versionRev, repo.Root, version)
+			}
+		}
+		if currentRev != rev {
+			// If the repo is does not matched the pinned version, update to that version
+			logEvent("rev-updated", eventFields{"repo": repo.Root, "from": currentRev, "rev": rev},
+				"Updating dep repo at %s to rev %s\n", repoDir, rev)
+			if err := repo.VCS.UpdateRev(repoDir, rev); err != nil {
+				if err == errOffline {
+					return nil, fmt.Errorf(
+						"rev %s of dep repo %s is not cached and cannot be fetched in offline mode", rev, repo.Root)
+				}
+				return nil, err
+			}
+		}
+	}
+	synced := &PinnedRepo{
+		Root:    repo.Root,
+		URL:     repo.Repo,
+		Source:  repo.Source,
+		VCS:     repo.VCS.Cmd.Cmd,
+		Rev:     rev,
+		Version: version,
+	}
+	if pinned != nil {
+		synced.Explicit = pinned.Explicit
+	}
+	// The pinned hash only applies if the repo stays at the pinned rev.
+	if pinned != nil && pinned.Rev == rev {
+		synced.Hash = pinned.Hash
+	}
+	hash, mismatch, err := hashRepo(synced, repoDir, hashStamped, manifest)
+	if err != nil {
+		return nil, err
+	}
+	if mismatch != nil {
+		return nil, errors.New(mismatch.String())
+	}
+	synced.Hash = hash
+	return synced, nil
 }
 
-// makePinMap creates a map of name -> rev from the entries in the pinlist in the project located at root.
-func makePinMap(root string) (map[string]string, error) {
-	pinnedVersions := make(map[string]string)
+// loadPinlistIfExists loads the pinlist in the project located at root. If there is no pinlist yet, an empty
+// one is returned.
+func loadPinlistIfExists(root string) (*Pinlist, error) {
 	pinlistFilename := filepath.Join(root, projectDirName, pinlistName)
 	pinlist, err := LoadPinlist(pinlistFilename)
 	switch {
 	case err == nil:
-		for _, dep := range pinlist.Deps {
-			pinnedVersions[dep.Name] = dep.Rev
-		}
+		return pinlist, nil
 	case os.IsNotExist(err):
+		return new(Pinlist), nil
 	default:
 		return nil, err
 	}
-	return pinnedVersions, nil
 }
 
-func findProjectDeps(context *build.Context, root string) (immediateDeps, projectPackages smap, err error) {
+// loadRequiredPinlist loads the pinlist in the project located at root. Unlike loadPinlistIfExists, it is an
+// error if there is no pinlist.
+func loadRequiredPinlist(root string) (*Pinlist, error) {
+	pinlistFilename := filepath.Join(root, projectDirName, pinlistName)
+	pinlist, err := LoadPinlist(pinlistFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("No pinlist file (looked for %s). Try running 'glp sync'.", pinlistFilename)
+		}
+		return nil, err
+	}
+	return pinlist, nil
+}
+
+// findProjectDeps finds the packages in the project located at root and their immediate (non-project)
+// dependencies, including the dependencies of their tests. Each dependency is mapped to how it is needed: in
+// prodScope if it is imported by non-test code (and testScope otherwise), on the platforms that import it. The
+// directories that were not searched for packages are returned as skipped (see findProjectPackages).
+func findProjectDeps(matrix *buildMatrix, root string) (immediateDeps map[string]depNeed,
+	projectPackages smap, skipped []skippedDir, err error) {
+
+	packages, skipped, err := findProjectPackages(matrix, root)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	immediateDeps = make(map[string]depNeed)
+	for name, imports := range packages {
+		projectPackages.Add(name)
+		for _, imp := range imports {
+			need := depNeed{Scope: prodScope, Platforms: imp.Platforms}
+			if imp.Kind != normalImport {
+				need.Scope = testScope
+			}
+			if old, ok := immediateDeps[imp.Path]; ok {
+				need = old.merge(need)
+			}
+			immediateDeps[imp.Path] = need
+		}
+	}
+
+	// Remove the intra-project deps from immediateDeps.
+	for _, pkg := range projectPackages {
+		delete(immediateDeps, pkg)
+	}
+
+	return immediateDeps, projectPackages, skipped, nil
+}
+
+// A skippedDir is a project directory that was not searched for packages.
+type skippedDir struct {
+	Dir    string // relative to the project root
+	Reason string
+}
+
+type skippedDirs []skippedDir
+
+func (s skippedDirs) Len() int           { return len(s) }
+func (s skippedDirs) Less(i, j int) bool { return s[i].Dir < s[j].Dir }
+func (s skippedDirs) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// findProjectPackages finds the Go packages in the project located at root (the package in the root directory
+// itself, if any, all the packages beneath src/, and all the packages beneath the config's source dirs) and
+// their non-stdlib imports. The result is keyed by package name, which is the import path for packages in src/
+// and the path relative to the root, starting with ".", for the others (see isLocalPackage). The directories
+// that are skipped (see findProjectDirs) and the packages excluded by the config are returned as skipped.
+func findProjectPackages(matrix *buildMatrix, root string) (map[string][]packageImport, []skippedDir, error) {
+	var skipped []skippedDir
+	names := make(map[string]string) // dir -> package name
 	srcDir := filepath.Join(root, "src")
-	possiblePackageDirs := FindDirsRecursively(srcDir)
-	possiblePackageDirs = append(possiblePackageDirs, ".")
-	for _, dir := range possiblePackageDirs {
-		pkg, err := context.ImportDir(dir, 0)
+	dirs, err := findProjectDirs(root, srcDir, &skipped)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, dir := range dirs {
+		name, err := filepath.Rel(srcDir, dir)
 		if err != nil {
-			if _, ok := err.(*build.NoGoError); ok {
-				continue
-			}
 			return nil, nil, err
 		}
+		names[dir] = filepath.ToSlash(name)
+	}
+	names[root] = "."
+	for _, sourceDir := range config.SourceDirs {
+		dirs, err := findProjectDirs(root, filepath.Join(root, sourceDir), &skipped)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, dir := range dirs {
+			name, err := filepath.Rel(root, dir)
+			if err != nil {
+				return nil, nil, err
+			}
+			names[dir] = "./" + filepath.ToSlash(name)
+		}
+	}
 
-		packageName := dir
-		if dir != "." {
-			packageName, err = filepath.Rel(srcDir, dir)
+	packages := make(map[string][]packageImport)
+	for dir, packageName := range names {
+		if pattern := config.excludedBy(packageName); pattern != "" {
+			rel, err := filepath.Rel(root, dir)
 			if err != nil {
 				return nil, nil, err
 			}
+			reason := fmt.Sprintf("package %s is excluded by %q in the config", packageName, pattern)
+			skipped = append(skipped, skippedDir{Dir: rel, Reason: reason})
+			continue
 		}
-		projectPackages.Add(packageName)
-		for _, dep := range findNonStdDeps(context, pkg) {
-			immediateDeps.Add(dep)
+		imports, err := matrix.findImports(dir)
+		if err != nil {
+			if _, ok := err.(*build.NoGoError); ok {
+				continue
+			}
+			return nil, nil, fmt.Errorf("cannot read project package %s (exclude it in %s to skip it): %s",
+				packageName, filepath.Join(projectDirName, configName), err)
 		}
+		packages[packageName] = imports
 	}
+	sort.Sort(skippedDirs(skipped))
+	return packages, skipped, nil
+}
 
-	// Remove the intra-project deps from immediateDeps. We need two steps because it's not valid to remove
-	// items from an smap while traversing it.
-	var toRemove []string
-	for _, dep := range immediateDeps {
-		if projectPackages.Contains(dep) {
-			toRemove = append(toRemove, dep)
+// findProjectDirs finds the directories in dir (a directory in the project located at root), recursively, in
+// which to look for project packages. Like the go tool, it skips directories whose names begin with "_" or "."
+// and directories named testdata, along with everything beneath them. Vendor directories (such as those
+// created by 'glp vendor') don't contain project packages, so they are skipped as well, as are the directories
+// ignored by the config. The skipped directories are appended to skipped.
+func findProjectDirs(root, dir string, skipped *[]skippedDir) ([]string, error) {
+	var dirs []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return nil
+			}
+			return err
 		}
+		if !info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		var reason string
+		switch {
+		case ignoreDirs[name]:
+			return filepath.SkipDir
+		case path == dir:
+		case config.ignoresDir(name):
+			reason = "ignored by the config"
+		case name == "vendor":
+			reason = "vendor directory"
+		case name == "testdata":
+			reason = "testdata directory"
+		case strings.HasPrefix(name, "_") || strings.HasPrefix(name, "."):
+			reason = "name begins with _ or ."
+		}
+		if reason != "" {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			*skipped = append(*skipped, skippedDir{Dir: rel, Reason: reason})
+			return filepath.SkipDir
+		}
+		dirs = append(dirs, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	for _, dep := range toRemove {
-		immediateDeps.Remove(dep)
-	}
+	return dirs, nil
+}
 
-	return immediateDeps, projectPackages, nil
+// isLocalPackage reports whether the project package name (see findProjectPackages) is for a package outside
+// of src/, which can't be imported.
+func isLocalPackage(name string) bool {
+	return name == "." || strings.HasPrefix(name, "./")
 }
 
-// Find the first-level deps for a package
-func findDeps(context *build.Context, dir string) (immediateDeps smap, err error) {
-	pkg, err := context.ImportDir(dir, 0)
+// Find the first-level deps for a dependency package. Test imports are only included if withTests is true.
+func findDeps(matrix *buildMatrix, dir string, withTests bool) ([]packageImport, error) {
+	imports, err := matrix.findImports(dir)
 	if err != nil {
 		return nil, err
 	}
-	return findNonStdDeps(context, pkg), nil
-}
-
-func findNonStdDeps(context *build.Context, pkg *build.Package) (immediateDeps smap) {
-	imports := pkg.Imports
-	imports = append(imports, pkg.TestImports...)
-	imports = append(imports, pkg.XTestImports...)
+	if withTests {
+		return imports, nil
+	}
+	var deps []packageImport
 	for _, imp := range imports {
-		if !pkgIsStd(context, imp) {
-			immediateDeps.Add(imp)
+		if imp.Kind == normalImport {
+			deps = append(deps, imp)
 		}
 	}
-	return immediateDeps
-}
-
-func pkgIsStd(context *build.Context, importPath string) bool {
-	pkg, err := context.Import(importPath, ".", 0)
-	return err == nil && pkg.Goroot
+	return deps, nil
 }
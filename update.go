@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+func runUpdate(root, gopath string, args []string) error {
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+	rev := fs.String("rev", "", "Update to this revision instead of the latest upstream revision")
+	version := fs.String("version", "", "Update to this tag or branch and follow it from now on")
+	opts := new(SyncOptions)
+	addSyncFlags(fs, opts)
+	importPaths, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	return Update(root, gopath, importPaths, *rev, *version, opts)
+}
+
+// Update moves the repos containing the given pinned dependencies (or all pinned repos, if importPaths is
+// empty) to a new revision and then re-syncs the project.
+//   - Each repo is fetched in the cache and moved to rev, or to the tag or branch version (which the repo
+//     follows from then on), or else according to its pinned version: to the latest revision of its branch,
+//     or to the newest tag with the same major version as its tag. A repo without a version is moved to the
+//     latest upstream revision. Giving rev drops the repo's version.
+//   - The repo's entry in the pinlist is rewritten with the new rev (and version)
+//   - The project is synced (using opts), which resolves the (possibly changed) transitive deps of the updated
+//     repos
+func Update(root, gopath string, importPaths []string, rev, version string, opts *SyncOptions) error {
+	pinlistFilename := filepath.Join(root, projectDirName, pinlistName)
+	if frozenMode {
+		return fmt.Errorf("cannot update %s because $GLP_FROZEN is set", pinlistFilename)
+	}
+	pinlist, err := LoadPinlist(pinlistFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("No pinlist file (looked for %s). Try running 'glp sync'.", pinlistFilename)
+		}
+		return err
+	}
+
+	var toUpdate []*PinnedRepo
+	if len(importPaths) == 0 {
+		for i := range pinlist.Repos {
+			toUpdate = append(toUpdate, &pinlist.Repos[i])
+		}
+	}
+	seen := make(map[string]bool)
+	for _, importPath := range importPaths {
+		pinned := pinlist.FindPackage(importPath)
+		if pinned == nil {
+			return fmt.Errorf("%s is not a pinned dependency", importPath)
+		}
+		if !seen[pinned.Root] {
+			seen[pinned.Root] = true
+			toUpdate = append(toUpdate, pinned)
+		}
+	}
+	if rev != "" && version != "" {
+		return errors.New("--rev and --version may not be used together")
+	}
+	if (rev != "" || version != "") && len(toUpdate) != 1 {
+		return errors.New("--rev and --version may only be used when updating a single repo")
+	}
+
+	cacheDir := config.cacheSrcDir(root)
+	for _, pinned := range toUpdate {
+		repo := pinned.RepoRoot()
+		dir := filepath.Join(cacheDir, pinned.Root)
+		newRev, newVersion := rev, version
+		if newVersion == "" && rev == "" {
+			newVersion = pinned.Version
+		}
+		var err error
+		if newVersion != "" {
+			newRev, newVersion, err = followVersion(repo, dir, newVersion, version != "")
+		}
+		if err == nil {
+			newRev, err = updateRepo(repo, dir, newRev)
+		}
+		if err != nil {
+			if err == errOffline {
+				return fmt.Errorf("cannot update dep repo %s: %s", pinned.Root, err)
+			}
+			return err
+		}
+		if pinned.Version != "" && newVersion == "" {
+			textf("Dep repo %s no longer follows version %s\n", pinned.Root, pinned.Version)
+		}
+		if newRev != pinned.Rev {
+			pinned.Hash = "" // sync records the hash of the new rev
+		}
+		pinned.Rev = newRev
+		pinned.Version = newVersion
+	}
+
+	if err := pinlist.Save(pinlistFilename); err != nil {
+		return err
+	}
+	return Sync(root, gopath, opts)
+}
+
+// followVersion works out where a repo that follows version (a tag or branch) should be updated to: the
+// latest upstream revision of the branch, or the newest tag with the same major version as the tag (see
+// newestMatchingTag), or the tag itself if exact is set. It fetches the cached repo at dir (creating it if
+// need be) and returns the revision and the version to pin.
+func followVersion(repo *RepoRoot, dir, version string, exact bool) (rev, newVersion string, err error) {
+	if err := cacheRepo(repo, dir); err != nil {
+		return "", "", err
+	}
+	textf("Fetching latest changes for %s\n", repo.Root)
+	if err := repo.VCS.Fetch(dir); err != nil {
+		return "", "", err
+	}
+	rev, branch, err := repo.VCS.ResolveVersion(dir, version)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot resolve version %s of dep repo %s: %s", version, repo.Root, err)
+	}
+	if branch || exact {
+		return rev, version, nil
+	}
+	tags, err := repo.VCS.TagNames(dir)
+	if err != nil {
+		return "", "", err
+	}
+	newest := newestMatchingTag(version, tags)
+	if newest == version {
+		return rev, version, nil
+	}
+	rev, _, err = repo.VCS.ResolveVersion(dir, newest)
+	if err != nil {
+		return "", "", err
+	}
+	logEvent("version-updated", eventFields{"repo": repo.Root, "from": version, "version": newest},
+		"Moving dep repo %s from version %s to %s\n", repo.Root, version, newest)
+	return rev, newest, nil
+}
+
+// newestMatchingTag returns the newest of tags that has the same major version as tag and is at least as new,
+// comparing them as semantic versions (with or without a leading "v", as long as tag and the result agree).
+// Pre-release tags are only considered if tag is a pre-release itself. If tag is not a semantic version, it is
+// returned unchanged.
+func newestMatchingTag(tag string, tags []string) string {
+	prefix := ""
+	if !strings.HasPrefix(tag, "v") {
+		prefix = "v"
+	}
+	current := prefix + tag
+	if !semver.IsValid(current) {
+		return tag
+	}
+	newest, newestVersion := tag, current
+	for _, t := range tags {
+		v := prefix + t
+		if !semver.IsValid(v) || (prefix == "") != strings.HasPrefix(t, "v") {
+			continue
+		}
+		if semver.Major(v) != semver.Major(current) {
+			continue
+		}
+		if semver.Prerelease(v) != "" && semver.Prerelease(current) == "" {
+			continue
+		}
+		if semver.Compare(v, newestVersion) > 0 {
+			newest, newestVersion = t, v
+		}
+	}
+	return newest
+}
+
+// cacheRepo makes sure that repo is in the cache at dir, creating it if need be, and that it fetches from the
+// right source.
+func cacheRepo(repo *RepoRoot, dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		textf("Dep repo %s does not exist; downloading...", repo.Root)
+		if err := repo.VCS.Create(dir, repo.fetchURL()); err != nil {
+			return err
+		}
+		logEvent("repo-fetched", eventFields{"repo": repo.Root, "url": repo.fetchURL(), "vcs": repo.VCS.Cmd.Cmd},
+			"done.\n")
+		return nil
+	}
+	return repo.pointAtSource(dir)
+}
+
+// updateRepo fetches the cached repo at dir and moves it to rev (or the latest upstream rev if rev is empty).
+// It returns the full ID of the new revision.
+func updateRepo(repo *RepoRoot, dir, rev string) (string, error) {
+	if err := cacheRepo(repo, dir); err != nil {
+		return "", err
+	}
+	oldRev, dirty, err := repo.VCS.GetRev(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(dirty) > 0 {
+		return "", fmt.Errorf("dep repo at %s is currently dirty:%s", dir, fileList(dirty))
+	}
+
+	if rev == "" {
+		textf("Fetching latest changes for %s\n", repo.Root)
+		if err := repo.VCS.Fetch(dir); err != nil {
+			return "", err
+		}
+		rev, err = repo.VCS.LatestRev(dir)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := repo.VCS.UpdateRev(dir, rev); err != nil {
+		return "", err
+	}
+	newRev, _, err := repo.VCS.GetRev(dir)
+	if err != nil {
+		return "", err
+	}
+	if newRev == oldRev {
+		textf("Dep repo %s is already at rev %s\n", repo.Root, newRev)
+	} else {
+		logEvent("rev-updated", eventFields{"repo": repo.Root, "from": oldRev, "rev": newRev},
+			"Updated dep repo %s from rev %s to %s\n", repo.Root, oldRev, newRev)
+	}
+	return newRev, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestNewestMatchingTag(t *testing.T) {
+	for _, tt := range []struct {
+		tag  string
+		tags []string
+		want string
+	}{
+		{"v1.2.0", nil, "v1.2.0"},
+		{"v1.2.0", []string{"v1.2.0", "v1.3.0", "v1.10.0", "v1.9.0", "v2.0.0", "v1.11.0-rc1", "junk"}, "v1.10.0"},
+		{"v1.3.0", []string{"v1.2.0"}, "v1.3.0"},
+		{"v0.1.0", []string{"v0.2.0", "v1.0.0"}, "v0.2.0"},
+		{"v2.0.0", []string{"v2.1.0", "v3.0.0"}, "v2.1.0"},
+		{"v1", []string{"v1.1", "v1.2.0"}, "v1.2.0"},
+		// The result has a leading "v" only if tag does.
+		{"1.2.0", []string{"1.3.0", "v1.4.0", "1.2.5"}, "1.3.0"},
+		{"v1.2.0", []string{"1.3.0"}, "v1.2.0"},
+		// Pre-releases only count if tag is one.
+		{"v1.2.0-rc1", []string{"v1.2.0-rc2"}, "v1.2.0-rc2"},
+		{"v1.2.0-rc1", []string{"v1.2.0-rc2", "v1.2.0"}, "v1.2.0"},
+		{"v1.2.0", []string{"v1.3.0-rc1"}, "v1.2.0"},
+		// Other tags are left alone.
+		{"release", []string{"v1.0.0", "release2"}, "release"},
+	} {
+		if got := newestMatchingTag(tt.tag, tt.tags); got != tt.want {
+			t.Errorf("newestMatchingTag(%q, %q): got %q; want %q", tt.tag, tt.tags, got, tt.want)
+		}
+	}
+}
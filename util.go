@@ -1,8 +1,14 @@
 package main
 
 import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 var ignoreDirs = map[string]bool{
@@ -10,7 +16,8 @@ var ignoreDirs = map[string]bool{
 	".hg":  true,
 }
 
-// FindDirsRecursively finds all directories in path, recursively (but skipping VCS metadata directories).
+// FindDirsRecursively finds all directories in path, recursively (but skipping VCS metadata directories and
+// the directories ignored by the config).
 func FindDirsRecursively(path string) []string {
 	var results []string
 	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
@@ -18,7 +25,7 @@ func FindDirsRecursively(path string) []string {
 			return err
 		}
 		if info.IsDir() {
-			if ignoreDirs[filepath.Base(path)] {
+			if config.ignoresDir(filepath.Base(path)) {
 				return filepath.SkipDir
 			}
 			results = append(results, path)
@@ -27,3 +34,107 @@ func FindDirsRecursively(path string) []string {
 	})
 	return results
 }
+
+// parseFlags parses args using fs, allowing flags to be interspersed with positional arguments (so that, for
+// instance, 'glp update foo --rev abc' works). It returns the positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// isRepoDir reports whether dir is the root of a git or hg repo.
+func isRepoDir(dir string) bool {
+	for name := range ignoreDirs {
+		if stat, err := os.Stat(filepath.Join(dir, name)); err == nil && stat.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// hashTree returns a checksum of the files in the directory tree at dir, skipping VCS metadata directories
+// (see hashFiles).
+func hashTree(dir string) (string, error) {
+	files := make(map[string][]byte)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if ignoreDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fileHash := sha256.New()
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(fileHash, link)
+		} else {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(fileHash, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		files[filepath.ToSlash(rel)] = fileHash.Sum(nil)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hashFiles(files), nil
+}
+
+// hashFiles returns a checksum of a set of files, given as a map from the relative path of each file (with
+// forward slashes) to the SHA-256 hash of its contents (or, for symlinks, of the link target). It covers the
+// path and contents of each file, taken in the order in which filepath.Walk visits them.
+func hashFiles(files map[string][]byte) string {
+	var paths walkOrder
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Sort(paths)
+	h := sha256.New()
+	for _, path := range paths {
+		fmt.Fprintf(h, "%x  %s\n", files[path], path)
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
+
+// walkOrder sorts slash-separated paths the way filepath.Walk visits them, comparing one path element at a
+// time (so "a/b" comes before "a.go").
+type walkOrder []string
+
+func (s walkOrder) Len() int      { return len(s) }
+func (s walkOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s walkOrder) Less(i, j int) bool {
+	a, b := strings.Split(s[i], "/"), strings.Split(s[j], "/")
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestWalkOrder(t *testing.T) {
+	paths := walkOrder{"a.go", "b", "a/c/d", "a-b", "a/b", "a"}
+	sort.Sort(paths)
+	want := []string{"a", "a/b", "a/c/d", "a-b", "a.go", "b"}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Fatalf("got %q; want %q", paths, want)
+		}
+	}
+}
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/tools/go/vcs"
 )
@@ -14,49 +24,151 @@ import (
 
 type VCSCmd struct {
 	*vcs.Cmd
+	// store is the location of the repo in the shared repo store (see store.go), or "" if the store is not in
+	// use.
+	store string
 }
 
 type RepoRoot struct {
 	VCS  VCSCmd
 	Repo string
 	Root string
+	// Source, if not empty, overrides Repo as the location from which the repo is fetched.
+	Source string
 }
 
+// fetchURL returns the location from which r is fetched: its source override, if any, or else its upstream
+// URL.
+func (r *RepoRoot) fetchURL() string {
+	if r.Source != "" {
+		return r.Source
+	}
+	return r.Repo
+}
+
+// pointAtSource makes sure that the cached copy of r in dir fetches from r.fetchURL(), which differs from the
+// location it was cloned from if r's source override has been added, changed, or removed since.
+func (r *RepoRoot) pointAtSource(dir string) error {
+	current, err := r.VCS.upstreamURL(dir)
+	if err != nil {
+		return err
+	}
+	url := r.fetchURL()
+	if current == url {
+		return nil
+	}
+	logEvent("source-changed", eventFields{"repo": r.Root, "from": current, "url": url},
+		"Dep repo %s is now fetched from %s (was %s)\n", r.Root, url, current)
+	return r.VCS.setUpstreamURL(dir, url)
+}
+
+// errOffline is returned by operations that would require network access when glp is in offline mode.
+var errOffline = errors.New("network access is disabled in offline mode")
+
 func RepoRootForImportPath(importPath string, verbose bool) (*RepoRoot, error) {
+	if offlineMode {
+		return nil, fmt.Errorf("cannot look up the repo for %s: %s", importPath, errOffline)
+	}
 	root, err := vcs.RepoRootForImportPath(importPath, verbose)
 	if err != nil {
 		return nil, err
 	}
-	return &RepoRoot{
-		VCS:  VCSCmd{root.VCS},
-		Repo: root.Repo,
-		Root: root.Root,
-	}, nil
+	return newRepoRoot(root.VCS, root.Repo, root.Root), nil
 }
 
-func (v VCSCmd) GetRev(dir string) (rev string, dirty bool, err error) {
-	switch v.Cmd.Cmd {
-	case "git":
-		out, err := v.runOutput(dir, "rev-parse HEAD")
+// lookupRepoRoot finds the repo containing importPath. In offline mode, only the repos in the cache directory
+// cacheDir are consulted; otherwise the repo is looked up using RepoRootForImportPath.
+func lookupRepoRoot(importPath, cacheDir string) (*RepoRoot, error) {
+	if offlineMode {
+		repo, err := cachedRepoRoot(cacheDir, importPath)
 		if err != nil {
-			return "", false, err
+			return nil, fmt.Errorf("cannot look up the repo for %s (it is not pinned or cached): %s",
+				importPath, errOffline)
 		}
-		rev = string(out)
-		changed, err := v.runOutput(dir, "diff-index HEAD")
-		if err != nil {
-			return "", false, err
+		return repo, nil
+	}
+	return RepoRootForImportPath(importPath, false)
+}
+
+// cachedRepoRoot finds the repo containing importPath among the repos in the cache directory cacheDir, using
+// only the VCS metadata of the cached repos.
+func cachedRepoRoot(cacheDir, importPath string) (*RepoRoot, error) {
+	root, cmd, ok := findCachedRepo(cacheDir, importPath)
+	if !ok {
+		return nil, fmt.Errorf("%s is not in any cached repo", importPath)
+	}
+	v := VCSCmd{Cmd: vcs.ByCmd(cmd)}
+	repo, err := v.upstreamURL(filepath.Join(cacheDir, filepath.FromSlash(root)))
+	if err != nil {
+		return nil, err
+	}
+	return newRepoRoot(v.Cmd, repo, root), nil
+}
+
+// findCachedRepo locates the cached repo containing importPath by looking for a VCS metadata directory in
+// importPath or one of its parents. It returns the repo's root import path and VCS command.
+func findCachedRepo(cacheDir, importPath string) (root, cmd string, ok bool) {
+	for dir := importPath; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		for _, cmd := range []string{"git", "hg"} {
+			stat, err := os.Stat(filepath.Join(cacheDir, filepath.FromSlash(dir), "."+cmd))
+			if err == nil && stat.IsDir() {
+				return dir, cmd, true
+			}
 		}
-		dirty = len(changed) > 0
-	case "hg":
-		out, err := v.runOutput(dir, "identify --debug --id")
-		if err != nil {
-			return "", false, err
+	}
+	return "", "", false
+}
+
+func newRepoRoot(cmd *vcs.Cmd, repo, root string) *RepoRoot {
+	return &RepoRoot{
+		VCS:  VCSCmd{Cmd: cmd, store: sharedStoreDir(root)},
+		Repo: repo,
+		Root: root,
+	}
+}
+
+// Create creates a new copy of repo in dir. If the shared repo store is in use, the copy is made from the
+// store (after bringing it up to date) rather than from repo. For Mercurial, go/vcs clones without a working
+// copy, so Create follows up by checking out the default branch. In offline mode, Create fails with errOffline
+// unless the repo is in the shared store.
+func (v VCSCmd) Create(dir, repo string) error {
+	if v.store != "" {
+		if err := v.createFromStore(dir, repo); err != nil {
+			return err
 		}
-		outString := strings.TrimSpace(string(out))
-		dirty = strings.HasSuffix(outString, "+")
-		rev = strings.TrimSuffix(outString, "+")
+	} else if offlineMode {
+		return errOffline
+	} else if err := v.Cmd.Create(dir, repo); err != nil {
+		return err
+	}
+	if v.Cmd.Cmd == "hg" {
+		return v.run(dir, "update default")
 	}
-	return strings.TrimSpace(rev), dirty, nil
+	return nil
+}
+
+// GetRev returns the checked-out revision of the repo in dir and the files that make it dirty (see
+// dirtyFiles): changes to tracked files, untracked files, and ignored files that would be built.
+func (v VCSCmd) GetRev(dir string) (rev string, dirty []FileChange, err error) {
+	var out []byte
+	switch v.Cmd.Cmd {
+	case "git":
+		out, err = v.runOutput(dir, "rev-parse HEAD")
+	case "hg":
+		out, err = v.runOutput(dir, "identify --debug --id")
+	default:
+		return "", nil, fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	// hg marks a modified working copy with "+", but that's covered by ChangedFiles.
+	rev = strings.TrimSuffix(strings.TrimSpace(string(out)), "+")
+	changes, err := v.ChangedFiles(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	return rev, dirtyFiles(changes), nil
 }
 
 func (v VCSCmd) UpdateRev(dir, rev string) error {
@@ -66,20 +178,15 @@ func (v VCSCmd) UpdateRev(dir, rev string) error {
 		out, err := v.runSilent(dir, "cat-file -t "+rev)
 		updateNeeded = (err != nil || string(bytes.TrimSpace(out)) != "commit")
 	case "hg":
-		panic("unimplemented")
+		out, err := v.runSilent(dir, "log -r "+rev+" --template {node}")
+		updateNeeded = (err != nil || len(bytes.TrimSpace(out)) == 0)
 	}
-	var cmd string
 	if updateNeeded {
-		switch v.Cmd.Cmd {
-		case "git":
-			cmd = "fetch"
-		case "hg":
-			panic("unimplemented")
-		}
-		if err := v.run(dir, cmd); err != nil {
+		if err := v.Fetch(dir); err != nil {
 			return err
 		}
 	}
+	var cmd string
 	switch v.Cmd.Cmd {
 	case "git":
 		// TODO: is it better to reset --hard instead of leaving a detached head?
@@ -90,28 +197,667 @@ func (v VCSCmd) UpdateRev(dir, rev string) error {
 	if err := v.run(dir, cmd+" "+rev); err != nil {
 		return err
 	}
-	return nil
+	return v.keepInStore(dir)
+}
+
+// Fetch pulls down any new upstream changes into the repo in dir without changing the working copy. If the
+// shared repo store is in use, the changes are fetched into the store and then copied from there. In offline
+// mode, only the changes already in the shared store (if any) are copied.
+func (v VCSCmd) Fetch(dir string) error {
+	if v.store != "" {
+		return v.fetchFromStore(dir)
+	}
+	if offlineMode {
+		return errOffline
+	}
+	switch v.Cmd.Cmd {
+	case "git":
+		return v.run(dir, "fetch")
+	case "hg":
+		return v.run(dir, "pull")
+	}
+	return fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+}
+
+// LatestRev returns the most recent upstream revision of the repo in dir, as of the last fetch.
+func (v VCSCmd) LatestRev(dir string) (string, error) {
+	var out []byte
+	var err error
+	switch v.Cmd.Cmd {
+	case "git":
+		out, err = v.runSilent(dir, "rev-parse origin/HEAD")
+		if err != nil {
+			// Older clones may not have origin/HEAD set.
+			out, err = v.runOutput(dir, "rev-parse origin/master")
+		}
+	case "hg":
+		out, err = v.runOutput(dir, "log -r default --template {node}")
+	default:
+		return "", fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// CommitTime returns the time at which rev was committed in the repo in dir.
+func (v VCSCmd) CommitTime(dir, rev string) (time.Time, error) {
+	var out []byte
+	var err error
+	switch v.Cmd.Cmd {
+	case "git":
+		out, err = v.runOutput(dir, "log -1 --format=%ct "+rev)
+	case "hg":
+		// hgdate is "<unix time> <tz offset>".
+		out, err = v.runOutput(dir, "log -r "+rev+" --template {date|hgdate}")
+	default:
+		return time.Time{}, fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return time.Time{}, fmt.Errorf("cannot find the commit time of rev %s in %s", rev, dir)
+	}
+	secs, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse the commit time of rev %s in %s: %s", rev, dir, err)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// Tags returns the tags of the repo in dir that are on rev itself (exact) and on rev or any of its
+// ancestors (all).
+func (v VCSCmd) Tags(dir, rev string) (exact, all []string, err error) {
+	var exactOut, allOut []byte
+	switch v.Cmd.Cmd {
+	case "git":
+		if exactOut, err = v.runOutput(dir, "tag --points-at "+rev); err != nil {
+			return nil, nil, err
+		}
+		allOut, err = v.runOutput(dir, "tag --merged "+rev)
+	case "hg":
+		if exactOut, err = v.runOutput(dir, "log -r "+rev+" --template {tags}"); err != nil {
+			return nil, nil, err
+		}
+		allOut, err = v.runOutput(dir, "log -r ancestors("+rev+")&tag() --template {tags}\\n")
+	default:
+		return nil, nil, fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return strings.Fields(string(exactOut)), strings.Fields(string(allOut)), nil
+}
+
+// FileAt returns the contents of the file path (relative to the repo root, with forward slashes) as committed at
+// rev in the repo in dir. If rev doesn't have the file, the error satisfies os.IsNotExist.
+func (v VCSCmd) FileAt(dir, rev, path string) ([]byte, error) {
+	notExist := &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	switch v.Cmd.Cmd {
+	case "git":
+		// ls-tree fails if rev doesn't exist, but prints nothing if it just doesn't have the file.
+		out, err := v.run1(dir, []string{"ls-tree", "-z", rev, "--", path}, true)
+		if err != nil {
+			return nil, err
+		}
+		// The entry is "<mode> <type> <object>\t<path>".
+		fields := strings.Fields(string(bytes.SplitN(out, []byte{'\t'}, 2)[0]))
+		if len(fields) != 3 || fields[1] != "blob" {
+			return nil, notExist
+		}
+		return v.run1(dir, []string{"cat-file", "blob", fields[2]}, true)
+	case "hg":
+		out, err := v.run1(dir, []string{"manifest", "-r", rev}, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range strings.Split(string(out), "\n") {
+			if name == path {
+				return v.run1(dir, []string{"cat", "-r", rev, "path:" + path}, true)
+			}
+		}
+		return nil, notExist
+	}
+	return nil, fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+}
+
+// CommittedFiles returns the files committed at rev in the repo in dir, mapping the path of each (relative to
+// the repo root, with forward slashes) to the SHA-256 hash of its contents, as for hashFiles. The contents are
+// exactly as committed: the working copy isn't read, and no line-ending conversion or other filtering is done.
+// Nested repos (git submodules and hg subrepos) are not included.
+func (v VCSCmd) CommittedFiles(dir, rev string) (map[string][]byte, error) {
+	switch v.Cmd.Cmd {
+	case "git":
+		return v.gitCommittedFiles(dir, rev)
+	case "hg":
+		return v.hgCommittedFiles(dir, rev)
+	}
+	return nil, fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+}
+
+func (v VCSCmd) gitCommittedFiles(dir, rev string) (map[string][]byte, error) {
+	out, err := v.run1(dir, []string{"ls-tree", "-r", "-z", "--full-tree", rev}, true)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	var objects bytes.Buffer
+	for _, entry := range bytes.Split(out, []byte{0}) {
+		if len(entry) == 0 {
+			continue
+		}
+		// Each entry is "<mode> <type> <object>\t<path>". Submodules have type "commit".
+		tab := bytes.IndexByte(entry, '\t')
+		if tab < 0 {
+			return nil, fmt.Errorf("unexpected output from git ls-tree: %q", entry)
+		}
+		fields := strings.Fields(string(entry[:tab]))
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected output from git ls-tree: %q", entry)
+		}
+		if fields[1] == "blob" {
+			paths = append(paths, string(entry[tab+1:]))
+			objects.WriteString(fields[2] + "\n")
+		}
+	}
+
+	// Read the contents of all the blobs with a single git process.
+	cmd := exec.Command(v.Cmd.Cmd, "cat-file", "--batch")
+	cmd.Dir = dir
+	cmd.Stdin = &objects
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	files, err := readBlobs(bufio.NewReader(stdout), paths)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("git cat-file --batch failed: %s\n%s", err, stderr.Bytes())
+	}
+	return files, nil
+}
+
+// readBlobs reads the output of 'git cat-file --batch' for the blobs of the files paths, and returns the hashes
+// of their contents as for CommittedFiles.
+func readBlobs(r *bufio.Reader, paths []string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for _, path := range paths {
+		// Each blob is "<object> blob <size>\n<contents>\n".
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("error reading the contents of %s: %s", path, err)
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 || fields[1] != "blob" {
+			return nil, fmt.Errorf("unexpected output from git cat-file: %q", header)
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected output from git cat-file: %q", header)
+		}
+		h := sha256.New()
+		if _, err := io.CopyN(h, r, size); err != nil {
+			return nil, err
+		}
+		if _, err := r.Discard(1); err != nil {
+			return nil, err
+		}
+		files[path] = h.Sum(nil)
+	}
+	return files, nil
+}
+
+func (v VCSCmd) hgCommittedFiles(dir, rev string) (map[string][]byte, error) {
+	// hg archive writes the committed files as a tar file, with every path under the prefix. --no-decode skips
+	// decode filters (such as the eol extension's), and ui.archivemeta=false leaves out .hg_archival.txt.
+	const prefix = "glp/"
+	args := []string{"archive", "-r", rev, "-t", "tar", "--no-decode", "--prefix", prefix,
+		"--config", "ui.archivemeta=false", "-"}
+	out, err := v.run1(dir, args, true)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(bytes.NewReader(out))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading hg archive of rev %s: %s", rev, err)
+		}
+		h := sha256.New()
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, err
+			}
+		case tar.TypeSymlink:
+			io.WriteString(h, hdr.Linkname)
+		default:
+			continue
+		}
+		files[strings.TrimPrefix(hdr.Name, prefix)] = h.Sum(nil)
+	}
+	return files, nil
+}
+
+// Export writes the files committed at rev in the repo in dir into the new directory dst. Like the go command
+// when it downloads a module, it reads them from an archive of rev, so the working copy (including ignored
+// files) doesn't matter.
+func (v VCSCmd) Export(dir, rev, dst string) error {
+	switch v.Cmd.Cmd {
+	case "git":
+		out, err := v.run1(dir, []string{"archive", "--format=tar", rev}, true)
+		if err != nil {
+			return err
+		}
+		return extractTar(bytes.NewReader(out), dst)
+	case "hg":
+		return v.runArgs(dir, "archive", "-r", rev, "-t", "files", "--no-decode",
+			"--config", "ui.archivemeta=false", dst)
+	default:
+		return fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+	}
+}
+
+// extractTar writes the directories, regular files, and symlinks in the tar file r into dst.
+func extractTar(r io.Reader, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading archive: %s", err)
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("bad path %q in archive", hdr.Name)
+		}
+		target := filepath.Join(dst, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writeFileFrom(target, tr, os.FileMode(hdr.Mode).Perm())
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, target)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeFileFrom writes the contents of r to the file filename, creating its directory if need be.
+func writeFileFrom(filename string, r io.Reader, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// A FileChange is a file of a repo that differs between two versions of its files: the working copy and the
+// checked-out revision (see VCSCmd.ChangedFiles), or the committed files and the ones in the manifest (see
+// diffFiles).
+type FileChange struct {
+	// Path is relative to the repo root and uses forward slashes.
+	Path string `json:"path"`
+	// Status is "modified", "added", "removed", "untracked", or "ignored".
+	Status string `json:"status"`
+}
+
+func (c FileChange) String() string { return c.Status + ": " + c.Path }
+
+// ChangedFiles lists the files in the working copy of the repo in dir that differ from its checked-out
+// revision: modified, added, and removed files as well as untracked and ignored ones. Files in repos nested
+// inside dir are left out.
+func (v VCSCmd) ChangedFiles(dir string) ([]FileChange, error) {
+	var changes []FileChange
+	switch v.Cmd.Cmd {
+	case "git":
+		// --no-optional-locks keeps git from refreshing the index, so that checking a repo doesn't modify it.
+		out, err := v.runOutput(dir, "--no-optional-locks status --porcelain -z --untracked-files=all --ignored")
+		if err != nil {
+			return nil, err
+		}
+		// Each entry is "XY path"; renames and copies are followed by an extra entry with the original path.
+		entries := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+		for i := 0; i < len(entries); i++ {
+			entry := entries[i]
+			if len(entry) < 4 {
+				continue
+			}
+			code := entry[0]
+			if code == ' ' {
+				code = entry[1]
+			}
+			change := FileChange{Path: entry[3:], Status: "modified"}
+			switch code {
+			case '?':
+				change.Status = "untracked"
+			case '!':
+				change.Status = "ignored"
+			case 'A':
+				change.Status = "added"
+			case 'D':
+				change.Status = "removed"
+			case 'R', 'C':
+				change.Status = "added"
+				i++
+			}
+			if change.Status == "ignored" && strings.HasSuffix(change.Path, "/") {
+				// git only lists the directory when everything in it is ignored.
+				files, err := listFiles(dir, change.Path)
+				if err != nil {
+					return nil, err
+				}
+				for _, file := range files {
+					changes = append(changes, FileChange{Path: file, Status: "ignored"})
+				}
+				continue
+			}
+			changes = append(changes, change)
+		}
+	case "hg":
+		out, err := v.runOutput(dir, "status --modified --added --removed --deleted --unknown --ignored")
+		if err != nil {
+			return nil, err
+		}
+		statuses := map[byte]string{
+			'M': "modified",
+			'A': "added",
+			'R': "removed",
+			'!': "removed",
+			'?': "untracked",
+			'I': "ignored",
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if len(line) < 3 {
+				continue
+			}
+			changes = append(changes, FileChange{Path: filepath.ToSlash(line[2:]), Status: statuses[line[0]]})
+		}
+	default:
+		return nil, fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+	}
+
+	var result []FileChange
+	for _, change := range changes {
+		change.Path = strings.TrimSuffix(change.Path, "/")
+		if !inNestedRepo(dir, change.Path) {
+			result = append(result, change)
+		}
+	}
+	return result, nil
+}
+
+// listFiles lists the files in the directory rel (relative to dir, with forward slashes), recursively, as paths
+// relative to dir. Nested repos are skipped.
+func listFiles(dir, rel string) ([]string, error) {
+	var files []string
+	root := filepath.Join(dir, filepath.FromSlash(rel))
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if ignoreDirs[info.Name()] || (p != root && isRepoDir(p)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		file, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(file))
+		return nil
+	})
+	return files, err
+}
+
+// dirtyFiles returns the changes that make a repo dirty: all of them except for ignored files that the go tool
+// doesn't build from (such as editor backups).
+func dirtyFiles(changes []FileChange) []FileChange {
+	var dirty []FileChange
+	for _, change := range changes {
+		if change.Status != "ignored" || buildFileExts[path.Ext(change.Path)] {
+			dirty = append(dirty, change)
+		}
+	}
+	return dirty
+}
+
+// buildFileExts lists the extensions of the files that the go tool builds packages from.
+var buildFileExts = map[string]bool{
+	".go":      true,
+	".c":       true,
+	".cc":      true,
+	".cpp":     true,
+	".cxx":     true,
+	".m":       true,
+	".h":       true,
+	".hh":      true,
+	".hpp":     true,
+	".hxx":     true,
+	".f":       true,
+	".F":       true,
+	".for":     true,
+	".f90":     true,
+	".s":       true,
+	".S":       true,
+	".sx":      true,
+	".swig":    true,
+	".swigcxx": true,
+	".syso":    true,
+}
+
+// inNestedRepo reports whether the path rel (relative to the repo root dir) is in, or is, another repo nested
+// inside the repo.
+func inNestedRepo(dir, rel string) bool {
+	for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+		if isRepoDir(filepath.Join(dir, filepath.FromSlash(p))) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveVersion returns the revision named by version, which must be a tag or a branch, in the repo in dir,
+// and reports whether version is a branch. Branches are resolved to their latest upstream revision as of the
+// last fetch. If version isn't found, the latest upstream changes are fetched before trying again.
+func (v VCSCmd) ResolveVersion(dir, version string) (rev string, branch bool, err error) {
+	rev, branch, ok := v.lookupVersion(dir, version)
+	if !ok {
+		if err := v.Fetch(dir); err != nil {
+			return "", false, err
+		}
+		if rev, branch, ok = v.lookupVersion(dir, version); !ok {
+			return "", false, fmt.Errorf("%s is not a tag or branch of the repo in %s", version, dir)
+		}
+	}
+	return rev, branch, nil
+}
+
+// lookupVersion is ResolveVersion without fetching. It reports whether version was found.
+func (v VCSCmd) lookupVersion(dir, version string) (rev string, branch, ok bool) {
+	var tagArgs, branchArgs []string
+	switch v.Cmd.Cmd {
+	case "git":
+		tagArgs = []string{"rev-parse", "--verify", "--quiet", "refs/tags/" + version + "^{commit}"}
+		branchArgs = []string{"rev-parse", "--verify", "--quiet", "refs/remotes/origin/" + version + "^{commit}"}
+	case "hg":
+		tagArgs = []string{"log", "-r", "tag('" + version + "')", "--template", "{node}"}
+		branchArgs = []string{"log", "-r", "max(branch('" + version + "'))", "--template", "{node}"}
+	default:
+		return "", false, false
+	}
+	for i, args := range [][]string{tagArgs, branchArgs} {
+		out, err := v.run1(dir, args, false)
+		if rev := strings.TrimSpace(string(out)); err == nil && rev != "" {
+			return rev, i == 1, true
+		}
+	}
+	return "", false, false
+}
+
+// TagNames returns the names of all the tags in the repo in dir.
+func (v VCSCmd) TagNames(dir string) ([]string, error) {
+	var out []byte
+	var err error
+	switch v.Cmd.Cmd {
+	case "git":
+		out, err = v.runOutput(dir, "tag --list")
+	case "hg":
+		out, err = v.runOutput(dir, "tags --quiet")
+	default:
+		return nil, fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// upstreamURL returns the URL of the upstream repo from which the repo in dir was cloned.
+func (v VCSCmd) upstreamURL(dir string) (string, error) {
+	var out []byte
+	var err error
+	switch v.Cmd.Cmd {
+	case "git":
+		out, err = v.runOutput(dir, "config --get remote.origin.url")
+	case "hg":
+		out, err = v.runOutput(dir, "paths default")
+	default:
+		return "", fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// setUpstreamURL changes the URL of the upstream repo of the repo in dir to url.
+func (v VCSCmd) setUpstreamURL(dir, url string) error {
+	switch v.Cmd.Cmd {
+	case "git":
+		return v.runArgs(dir, "remote", "set-url", "origin", url)
+	case "hg":
+		filename := filepath.Join(dir, ".hg", "hgrc")
+		hgrc, err := ioutil.ReadFile(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return ioutil.WriteFile(filename, []byte(setHgrcDefaultPath(string(hgrc), url)), 0666)
+	}
+	return fmt.Errorf("%s is not a VCS supported by glp", v.Name)
+}
+
+// setHgrcDefaultPath returns the hgrc file contents with paths.default set to url, leaving everything else
+// alone.
+func setHgrcDefaultPath(hgrc, url string) string {
+	var lines []string
+	if hgrc != "" {
+		lines = strings.Split(strings.TrimSuffix(hgrc, "\n"), "\n")
+	}
+	setting := "default = " + url
+	var result []string
+	inPaths := false   // whether the current line is in the [paths] section
+	inDefault := false // whether the current line continues the old default setting
+	done := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if inDefault {
+			if trimmed != "" && (line[0] == ' ' || line[0] == '\t') {
+				continue
+			}
+			inDefault = false
+		}
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			if inPaths && !done {
+				result = append(result, setting)
+				done = true
+			}
+			inPaths = trimmed == "[paths]"
+		} else if inPaths && line != "" && line[0] != ' ' && line[0] != '\t' {
+			// Replace the first default setting; hg would use the last one, so drop any others.
+			if i := strings.Index(line, "="); i >= 0 && strings.TrimSpace(line[:i]) == "default" {
+				if !done {
+					result = append(result, setting)
+					done = true
+				}
+				inDefault = true
+				continue
+			}
+		}
+		result = append(result, line)
+	}
+	if !done {
+		if !inPaths {
+			if len(result) > 0 {
+				result = append(result, "")
+			}
+			result = append(result, "[paths]")
+		}
+		result = append(result, setting)
+	}
+	return strings.Join(result, "\n") + "\n"
 }
 
 // run runs the command line cmd in the given directory. If an error occurs, run prints the command line and
 // the command's combined stdout+stderr to standard error. Otherwise run discards the command's output.
 func (v VCSCmd) run(dir, cmd string) error {
-	_, err := v.run1(dir, cmd, true)
+	_, err := v.run1(dir, strings.Fields(cmd), true)
+	return err
+}
+
+// runArgs is like run, but takes the arguments individually (for arguments such as paths that may contain
+// spaces).
+func (v VCSCmd) runArgs(dir string, args ...string) error {
+	_, err := v.run1(dir, args, true)
 	return err
 }
 
-// runOutput is like run but returns the output of the command.
+// runOutput is like run but returns the standard output of the command.
 func (v VCSCmd) runOutput(dir, cmd string) ([]byte, error) {
-	return v.run1(dir, cmd, true)
+	return v.run1(dir, strings.Fields(cmd), true)
 }
 
 // runSilent is like runOutput but does not print anything on failure.
 func (v VCSCmd) runSilent(dir, cmd string) ([]byte, error) {
-	return v.run1(dir, cmd, false)
+	return v.run1(dir, strings.Fields(cmd), false)
 }
 
-// run1 is the generalized implementation of run and runOutput.
-func (v VCSCmd) run1(dir string, cmdline string, verbose bool) ([]byte, error) {
+// run1 is the generalized implementation of run and runOutput. On failure, if verbose is set, both stdout and
+// stderr are printed.
+func (v VCSCmd) run1(dir string, args []string, verbose bool) ([]byte, error) {
 	_, err := exec.LookPath(v.Cmd.Cmd)
 	if err != nil {
 		fmt.Fprintf(os.Stderr,
@@ -120,7 +866,6 @@ func (v VCSCmd) run1(dir string, cmdline string, verbose bool) ([]byte, error) {
 		return nil, err
 	}
 
-	args := strings.Fields(cmdline)
 	cmd := exec.Command(v.Cmd.Cmd, args...)
 	cmd.Dir = dir
 	cmd.Env = mergeEnv(os.Environ(), "PWD", cmd.Dir)
@@ -128,17 +873,18 @@ func (v VCSCmd) run1(dir string, cmdline string, verbose bool) ([]byte, error) {
 		fmt.Printf("cd %s\n", dir)
 		fmt.Printf("%s %s\n", v.Cmd, strings.Join(args, " "))
 	}
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	cmd.Stderr = &buf
+	// Only stdout is returned, since callers parse it and warnings on stderr would get mixed in.
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
 	err = cmd.Run()
-	out := buf.Bytes()
 	if err != nil {
 		if verbose || vcs.Verbose {
 			fmt.Fprintf(os.Stderr, "# cd %s; %s %s\n", dir, v.Cmd, strings.Join(args, " "))
-			os.Stderr.Write(out)
+			os.Stderr.Write(stdout.Bytes())
+			os.Stderr.Write(stderr.Bytes())
 		}
 		return nil, err
 	}
-	return out, nil
+	return stdout.Bytes(), nil
 }
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/vcs"
+)
+
+// forEachVCS runs f as a subtest for each VCS supported by glp, skipping the ones that aren't installed.
+// Each subtest gets a fresh temporary directory.
+func forEachVCS(t *testing.T, f func(t *testing.T, v VCSCmd, tmp string)) {
+	for _, cmd := range []string{"git", "hg"} {
+		t.Run(cmd, func(t *testing.T) {
+			if _, err := exec.LookPath(cmd); err != nil {
+				t.Skipf("%s is not installed", cmd)
+			}
+			tmp, err := ioutil.TempDir("", "glp-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+			f(t, VCSCmd{Cmd: vcs.ByCmd(cmd)}, tmp)
+		})
+	}
+}
+
+// A testRepo is a local repo that stands in for an upstream repo (or is a clone of one).
+type testRepo struct {
+	t   *testing.T
+	cmd string
+	dir string
+}
+
+func newTestRepo(t *testing.T, cmd, dir string) *testRepo {
+	r := &testRepo{t: t, cmd: cmd, dir: dir}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	r.run("init")
+	return r
+}
+
+func (r *testRepo) run(args ...string) string {
+	r.t.Helper()
+	cmd := exec.Command(r.cmd, args...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=glp", "GIT_AUTHOR_EMAIL=glp@example.com",
+		"GIT_COMMITTER_NAME=glp", "GIT_COMMITTER_EMAIL=glp@example.com",
+		"HGUSER=glp", "HGPLAIN=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("%s %s: %s\n%s", r.cmd, strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func (r *testRepo) write(name, contents string) {
+	r.t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(r.dir, name), []byte(contents), 0644); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *testRepo) read(name string) string {
+	r.t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(r.dir, name))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return string(b)
+}
+
+// commit writes the file name and commits it (along with any other changes), returning the new revision.
+func (r *testRepo) commit(name, contents string) string {
+	r.t.Helper()
+	r.write(name, contents)
+	switch r.cmd {
+	case "git":
+		r.run("add", "-A")
+		r.run("commit", "-m", "change "+name)
+		return r.run("rev-parse", "HEAD")
+	default:
+		r.run("commit", "-A", "-m", "change "+name)
+		return r.run("log", "-r", ".", "--template", "{node}")
+	}
+}
+
+// clone clones r into dir using v.Create.
+func (r *testRepo) clone(v VCSCmd, dir string) *testRepo {
+	r.t.Helper()
+	if err := v.Create(dir, r.dir); err != nil {
+		r.t.Fatalf("Create: %s", err)
+	}
+	return &testRepo{t: r.t, cmd: r.cmd, dir: dir}
+}
+
+func checkRev(t *testing.T, v VCSCmd, dir, want string) {
+	t.Helper()
+	rev, dirty, err := v.GetRev(dir)
+	if err != nil {
+		t.Fatalf("GetRev: %s", err)
+	}
+	if rev != want {
+		t.Errorf("GetRev: got rev %s; want %s", rev, want)
+	}
+	if len(dirty) > 0 {
+		t.Errorf("GetRev: got dirty files %v; want none", dirty)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	forEachVCS(t, func(t *testing.T, v VCSCmd, tmp string) {
+		upstream := newTestRepo(t, v.Cmd.Cmd, filepath.Join(tmp, "upstream"))
+		upstream.commit("a.go", "package a // 1\n")
+		rev := upstream.commit("a.go", "package a // 2\n")
+
+		clone := upstream.clone(v, filepath.Join(tmp, "clone"))
+		checkRev(t, v, clone.dir, rev)
+		if got, want := clone.read("a.go"), "package a // 2\n"; got != want {
+			t.Errorf("a.go: got %q; want %q", got, want)
+		}
+		url, err := v.upstreamURL(clone.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if url != upstream.dir {
+			t.Errorf("upstreamURL: got %q; want %q", url, upstream.dir)
+		}
+	})
+}
+
+func TestUpdateRevPresent(t *testing.T) {
+	forEachVCS(t, func(t *testing.T, v VCSCmd, tmp string) {
+		upstream := newTestRepo(t, v.Cmd.Cmd, filepath.Join(tmp, "upstream"))
+		rev1 := upstream.commit("a.go", "package a // 1\n")
+		upstream.commit("a.go", "package a // 2\n")
+		clone := upstream.clone(v, filepath.Join(tmp, "clone"))
+
+		if err := v.UpdateRev(clone.dir, rev1); err != nil {
+			t.Fatalf("UpdateRev: %s", err)
+		}
+		checkRev(t, v, clone.dir, rev1)
+		if got, want := clone.read("a.go"), "package a // 1\n"; got != want {
+			t.Errorf("a.go: got %q; want %q", got, want)
+		}
+	})
+}
+
+func TestUpdateRevNeedsPull(t *testing.T) {
+	forEachVCS(t, func(t *testing.T, v VCSCmd, tmp string) {
+		upstream := newTestRepo(t, v.Cmd.Cmd, filepath.Join(tmp, "upstream"))
+		upstream.commit("a.go", "package a // 1\n")
+		clone := upstream.clone(v, filepath.Join(tmp, "clone"))
+		rev2 := upstream.commit("a.go", "package a // 2\n")
+
+		if err := v.UpdateRev(clone.dir, rev2); err != nil {
+			t.Fatalf("UpdateRev: %s", err)
+		}
+		checkRev(t, v, clone.dir, rev2)
+
+		// Offline, a missing rev can't be pulled.
+		rev3 := upstream.commit("a.go", "package a // 3\n")
+		offlineMode = true
+		defer func() { offlineMode = false }()
+		if err := v.UpdateRev(clone.dir, rev3); err != errOffline {
+			t.Errorf("UpdateRev in offline mode: got %v; want errOffline", err)
+		}
+	})
+}
+
+func TestUpdateRevDirty(t *testing.T) {
+	forEachVCS(t, func(t *testing.T, v VCSCmd, tmp string) {
+		upstream := newTestRepo(t, v.Cmd.Cmd, filepath.Join(tmp, "upstream"))
+		rev1 := upstream.commit("a.go", "package a // 1\n")
+		rev2 := upstream.commit("a.go", "package a // 2\n")
+		clone := upstream.clone(v, filepath.Join(tmp, "clone"))
+		clone.write("a.go", "package a // local change\n")
+		clone.write("b.go", "package a\n")
+
+		rev, dirty, err := v.GetRev(clone.dir)
+		if err != nil {
+			t.Fatalf("GetRev: %s", err)
+		}
+		if rev != rev2 {
+			t.Errorf("GetRev: got rev %s; want %s", rev, rev2)
+		}
+		want := []FileChange{{"a.go", "modified"}, {"b.go", "untracked"}}
+		if len(dirty) != len(want) || dirty[0] != want[0] || dirty[1] != want[1] {
+			t.Errorf("GetRev: got dirty files %v; want %v", dirty, want)
+		}
+
+		if err := v.UpdateRev(clone.dir, rev1); err == nil {
+			t.Error("UpdateRev succeeded with a dirty working copy")
+		}
+		if got, want := clone.read("a.go"), "package a // local change\n"; got != want {
+			t.Errorf("a.go: got %q; want %q (local change lost)", got, want)
+		}
+	})
+}
+
+func TestResolveVersion(t *testing.T) {
+	forEachVCS(t, func(t *testing.T, v VCSCmd, tmp string) {
+		upstream := newTestRepo(t, v.Cmd.Cmd, filepath.Join(tmp, "upstream"))
+		rev1 := upstream.commit("a.go", "package a // 1\n")
+		upstream.commit("a.go", "package a // 2\n")
+		var rev3 string
+		switch v.Cmd.Cmd {
+		case "git":
+			upstream.run("tag", "v1.0", rev1)
+			upstream.run("checkout", "-b", "dev")
+			rev3 = upstream.commit("a.go", "package a // 3\n")
+		default:
+			upstream.run("tag", "-r", rev1, "v1.0")
+			upstream.run("branch", "dev")
+			rev3 = upstream.commit("a.go", "package a // 3\n")
+		}
+		clone := upstream.clone(v, filepath.Join(tmp, "clone"))
+
+		for _, tt := range []struct {
+			version string
+			rev     string
+			branch  bool
+		}{
+			{"v1.0", rev1, false},
+			{"dev", rev3, true},
+		} {
+			rev, branch, err := v.ResolveVersion(clone.dir, tt.version)
+			if err != nil {
+				t.Errorf("ResolveVersion(%s): %s", tt.version, err)
+				continue
+			}
+			if rev != tt.rev || branch != tt.branch {
+				t.Errorf("ResolveVersion(%s): got (%s, %t); want (%s, %t)",
+					tt.version, rev, branch, tt.rev, tt.branch)
+			}
+		}
+		if _, _, err := v.ResolveVersion(clone.dir, "nope"); err == nil {
+			t.Error("ResolveVersion(nope) succeeded")
+		}
+
+		exact, _, err := v.Tags(clone.dir, rev1)
+		if err != nil {
+			t.Fatalf("Tags: %s", err)
+		}
+		if len(exact) != 1 || exact[0] != "v1.0" {
+			t.Errorf("Tags(%s): got exact tags %v; want [v1.0]", rev1, exact)
+		}
+	})
+}
+
+func TestSetUpstreamURL(t *testing.T) {
+	forEachVCS(t, func(t *testing.T, v VCSCmd, tmp string) {
+		upstream := newTestRepo(t, v.Cmd.Cmd, filepath.Join(tmp, "upstream"))
+		upstream.commit("a.go", "package a\n")
+		clone := upstream.clone(v, filepath.Join(tmp, "clone"))
+
+		mirror := filepath.Join(tmp, "mirror")
+		if err := v.setUpstreamURL(clone.dir, mirror); err != nil {
+			t.Fatalf("setUpstreamURL: %s", err)
+		}
+		url, err := v.upstreamURL(clone.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if url != mirror {
+			t.Errorf("upstreamURL: got %q; want %q", url, mirror)
+		}
+	})
+}
+
+func TestSetHgrcDefaultPath(t *testing.T) {
+	for _, tt := range []struct {
+		hgrc string
+		want string
+	}{
+		{
+			hgrc: "",
+			want: "[paths]\ndefault = NEW\n",
+		},
+		{
+			hgrc: "[ui]\nusername = x\n",
+			want: "[ui]\nusername = x\n\n[paths]\ndefault = NEW\n",
+		},
+		{
+			hgrc: "[paths]\ndefault = OLD\n",
+			want: "[paths]\ndefault = NEW\n",
+		},
+		{
+			hgrc: "[ui]\nusername = x\n[paths]\nfork = F\ndefault=OLD\n[extensions]\nrebase =\n",
+			want: "[ui]\nusername = x\n[paths]\nfork = F\ndefault = NEW\n[extensions]\nrebase =\n",
+		},
+		{
+			// A [paths] section without a default.
+			hgrc: "[paths]\nfork = F\n[ui]\nverbose = true\n",
+			want: "[paths]\nfork = F\ndefault = NEW\n[ui]\nverbose = true\n",
+		},
+		{
+			// Continuation lines of the old value are dropped, as are later defaults.
+			hgrc: "[paths]\ndefault = OLD\n  MORE\ndefault-push = P\ndefault = OLD2\n",
+			want: "[paths]\ndefault = NEW\ndefault-push = P\n",
+		},
+		{
+			// A default in another section is not the path.
+			hgrc: "[other]\ndefault = X\n",
+			want: "[other]\ndefault = X\n\n[paths]\ndefault = NEW\n",
+		},
+	} {
+		if got := setHgrcDefaultPath(tt.hgrc, "NEW"); got != tt.want {
+			t.Errorf("setHgrcDefaultPath(%q): got %q; want %q", tt.hgrc, got, tt.want)
+		}
+	}
+}
+
+func TestCommittedFiles(t *testing.T) {
+	forEachVCS(t, func(t *testing.T, v VCSCmd, tmp string) {
+		upstream := newTestRepo(t, v.Cmd.Cmd, filepath.Join(tmp, "upstream"))
+		if err := os.MkdirAll(filepath.Join(upstream.dir, "a"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		upstream.write("a/b.go", "package b\n")
+		if err := os.Symlink("a/b.go", filepath.Join(upstream.dir, "link.go")); err != nil {
+			t.Fatal(err)
+		}
+		rev := upstream.commit("a.go", "package a\r\n")
+		clone := upstream.clone(v, filepath.Join(tmp, "clone"))
+
+		// For a clean checkout, the hash of the committed files is the hash of the working copy.
+		files, err := v.CommittedFiles(clone.dir, rev)
+		if err != nil {
+			t.Fatalf("CommittedFiles: %s", err)
+		}
+		if len(files) != 3 {
+			t.Errorf("CommittedFiles: got %d files; want 3", len(files))
+		}
+		want, err := hashTree(clone.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hashFiles(files); got != want {
+			t.Errorf("CommittedFiles: got hash %s; want %s (the hash of the checkout)", got, want)
+		}
+
+		// Changes to the working copy don't count.
+		clone.write("a.go", "package a // changed\n")
+		clone.write("c.go.orig", "package a\n")
+		files, err = v.CommittedFiles(clone.dir, rev)
+		if err != nil {
+			t.Fatalf("CommittedFiles: %s", err)
+		}
+		if got := hashFiles(files); got != want {
+			t.Errorf("CommittedFiles after changing the working copy: got hash %s; want %s", got, want)
+		}
+	})
+}
+
+func TestRunOutputIgnoresStderr(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	v := VCSCmd{Cmd: &vcs.Cmd{Name: "sh", Cmd: "sh"}}
+	out, err := v.run1("", []string{"-c", `printf 'a.go\0'; echo 'warning: could not open directory' >&2`}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out), "a.go\x00"; got != want {
+		t.Errorf("got output %q; want %q", got, want)
+	}
+}
+
+func TestExport(t *testing.T) {
+	forEachVCS(t, func(t *testing.T, v VCSCmd, tmp string) {
+		upstream := newTestRepo(t, v.Cmd.Cmd, filepath.Join(tmp, "upstream"))
+		if err := os.MkdirAll(filepath.Join(upstream.dir, "a"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		upstream.write("a/b.go", "package b\n")
+		rev := upstream.commit("a.go", "package a\n")
+		clone := upstream.clone(v, filepath.Join(tmp, "clone"))
+		clone.write("a.go", "package a // changed\n")
+		clone.write("notes.txt", "untracked\n")
+
+		dst := filepath.Join(tmp, "export")
+		if err := v.Export(clone.dir, rev, dst); err != nil {
+			t.Fatalf("Export: %s", err)
+		}
+		for name, want := range map[string]string{"a.go": "package a\n", "a/b.go": "package b\n"} {
+			b, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+			if err != nil || string(b) != want {
+				t.Errorf("Export: got %s %q (err=%v); want the committed contents", name, b, err)
+			}
+		}
+		// Neither untracked files nor archive metadata are exported.
+		for _, name := range []string{"notes.txt", ".hg_archival.txt"} {
+			if _, err := os.Stat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+				t.Errorf("Export: got %s (err=%v); want it left out", name, err)
+			}
+		}
+	})
+}
+
+func TestFileAt(t *testing.T) {
+	forEachVCS(t, func(t *testing.T, v VCSCmd, tmp string) {
+		upstream := newTestRepo(t, v.Cmd.Cmd, filepath.Join(tmp, "upstream"))
+		if err := os.MkdirAll(filepath.Join(upstream.dir, "a"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		upstream.write("a/b.go", "package b\n")
+		rev1 := upstream.commit("go.mod", "module a\n")
+		upstream.commit("go.mod", "module a\n\ngo 1.16\n")
+		clone := upstream.clone(v, filepath.Join(tmp, "clone"))
+
+		for _, tt := range []struct {
+			path string
+			want string
+		}{
+			{"go.mod", "module a\n"},
+			{"a/b.go", "package b\n"},
+		} {
+			got, err := v.FileAt(clone.dir, rev1, tt.path)
+			if err != nil {
+				t.Errorf("FileAt(%s): %s", tt.path, err)
+				continue
+			}
+			if string(got) != tt.want {
+				t.Errorf("FileAt(%s): got %q; want %q", tt.path, got, tt.want)
+			}
+		}
+		for _, path := range []string{"a", "nope.go"} {
+			if _, err := v.FileAt(clone.dir, rev1, path); !os.IsNotExist(err) {
+				t.Errorf("FileAt(%s): got error %v; want one for a file that doesn't exist", path, err)
+			}
+		}
+		if _, err := v.FileAt(clone.dir, "nope", "go.mod"); err == nil || os.IsNotExist(err) {
+			t.Errorf("FileAt at a missing rev: got error %v; want one for the rev", err)
+		}
+	})
+}
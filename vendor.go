@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const vendorManifestName = "glp-vendor.json"
+
+// A vendorManifest records the repos that 'glp vendor' copied into a vendor directory. It is stored in the
+// vendor directory as vendorManifestName.
+type vendorManifest struct {
+	Repos []vendoredRepo `json:"repos"`
+}
+
+// A vendoredRepo is a pinned repo copied into a vendor directory.
+type vendoredRepo struct {
+	Root string `json:"root"`
+	URL  string `json:"url"`
+	// Source is the repo's source override, if it has one (see PinnedRepo).
+	Source string `json:"source,omitempty"`
+	VCS    string `json:"vcs"`
+	Rev    string `json:"rev"`
+	// Hash is a checksum of the repo's files as they were copied (see hashTree).
+	Hash string `json:"hash"`
+}
+
+func runVendor(root, gopath string, args []string) error {
+	fs := flag.NewFlagSet("vendor", flag.ContinueOnError)
+	check := fs.Bool("check", false,
+		"Check the existing vendor directory against glp/deps.json instead of writing it")
+	dir := fs.String("dir", "", "Use `DIR` (relative to the project root) as the vendor directory")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments to vendor: %v", args)
+	}
+	vendorDir := *dir
+	if vendorDir == "" {
+		vendorDir, err = findVendorDir(root, gopath)
+		if err != nil {
+			return err
+		}
+	}
+	if !filepath.IsAbs(vendorDir) {
+		vendorDir = filepath.Join(root, vendorDir)
+	}
+	if *check {
+		return CheckVendor(root, vendorDir)
+	}
+	return Vendor(root, vendorDir)
+}
+
+// findVendorDir picks the vendor directory for the project located at root: root/vendor if the project only
+// has a package in the root directory, or else the vendor directory in the deepest directory beneath src/ that
+// contains all the project's packages (for the go tool only applies vendor directories within a $GOPATH).
+func findVendorDir(root, gopath string) (string, error) {
+	matrix, err := newBuildMatrix(gopath, config.buildOptions())
+	if err != nil {
+		return "", err
+	}
+	packages, _, err := findProjectPackages(matrix, root)
+	if err != nil {
+		return "", err
+	}
+	var srcPackages []string
+	for name := range packages {
+		if !isLocalPackage(name) {
+			srcPackages = append(srcPackages, name)
+		}
+	}
+	if len(srcPackages) == 0 {
+		return filepath.Join(root, "vendor"), nil
+	}
+	common := commonImportPath(srcPackages)
+	if common == "" {
+		return "", errors.New("the project's packages in src/ have no common parent directory; " +
+			"choose a vendor directory with -dir")
+	}
+	return filepath.Join(root, "src", filepath.FromSlash(common), "vendor"), nil
+}
+
+// commonImportPath returns the longest import path that is, or is a parent of, every path in paths (which
+// must not be empty). It returns "" if there is no such path.
+func commonImportPath(paths []string) string {
+	common := strings.Split(paths[0], "/")
+	for _, p := range paths[1:] {
+		parts := strings.Split(p, "/")
+		i := 0
+		for i < len(common) && i < len(parts) && common[i] == parts[i] {
+			i++
+		}
+		common = common[:i]
+	}
+	return strings.Join(common, "/")
+}
+
+// Vendor copies every pinned repo from the cache into vendorDir, without VCS metadata, and writes a manifest
+// recording what was copied. The cache must match the pinlist exactly (no missing, mismatched, or dirty
+// repos). Anything previously in vendorDir is removed, so vendorDir must either not exist or have been
+// written by Vendor.
+func Vendor(root, vendorDir string) error {
+	pinlist, err := loadRequiredPinlist(root)
+	if err != nil {
+		return err
+	}
+	report, err := Verify(root, pinlist)
+	if err != nil {
+		return err
+	}
+	if err := report.CheckHashes(root); err != nil {
+		return err
+	}
+	if err := report.ExactErr(); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(vendorDir); err == nil {
+		if _, err := os.Stat(filepath.Join(vendorDir, vendorManifestName)); err != nil {
+			return fmt.Errorf("%s already exists and was not written by 'glp vendor'", vendorDir)
+		}
+		if err := os.RemoveAll(vendorDir); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(vendorDir, 0755); err != nil {
+		return err
+	}
+
+	cache := config.cacheSrcDir(root)
+	for _, repo := range pinlist.Repos {
+		src := filepath.Join(cache, filepath.FromSlash(repo.Root))
+		if err := copyTree(src, filepath.Join(vendorDir, filepath.FromSlash(repo.Root))); err != nil {
+			return err
+		}
+	}
+	// Hash the repos once they've all been copied, since a repo may contain another (nested) one.
+	manifest := new(vendorManifest)
+	for _, repo := range pinlist.Repos {
+		hash, err := hashTree(filepath.Join(vendorDir, filepath.FromSlash(repo.Root)))
+		if err != nil {
+			return err
+		}
+		manifest.Repos = append(manifest.Repos, vendoredRepo{
+			Root:   repo.Root,
+			URL:    repo.URL,
+			Source: repo.Source,
+			VCS:    repo.VCS,
+			Rev:    repo.Rev,
+			Hash:   hash,
+		})
+		logEvent("repo-vendored", eventFields{"repo": repo.Root, "rev": repo.Rev},
+			"Vendored %s at rev %s\n", repo.Root, repo.Rev)
+	}
+	b, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(vendorDir, vendorManifestName), b, 0644); err != nil {
+		return err
+	}
+	logEvent("vendored", eventFields{"dir": vendorDir, "repos": len(manifest.Repos)},
+		"Vendored %d repos into %s.\n", len(manifest.Repos), vendorDir)
+	return nil
+}
+
+// CheckVendor checks that the vendor directory vendorDir (as written by Vendor) matches the pinlist: that it
+// has every pinned repo at its pinned rev and nothing else, and that none of the vendored files have been
+// changed.
+func CheckVendor(root, vendorDir string) error {
+	pinlist, err := loadRequiredPinlist(root)
+	if err != nil {
+		return err
+	}
+	manifestFilename := filepath.Join(vendorDir, vendorManifestName)
+	b, err := ioutil.ReadFile(manifestFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("No vendor manifest (looked for %s). Try running 'glp vendor'.",
+				manifestFilename)
+		}
+		return err
+	}
+	manifest := new(vendorManifest)
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return fmt.Errorf("cannot read vendor manifest %s: %s", manifestFilename, err)
+	}
+
+	var problems []string
+	vendored := make(map[string]vendoredRepo)
+	for _, repo := range manifest.Repos {
+		vendored[repo.Root] = repo
+		pinned := pinlist.Find(repo.Root)
+		switch {
+		case pinned == nil:
+			problems = append(problems, fmt.Sprintf("repo %s is vendored but not pinned", repo.Root))
+			continue
+		case pinned.Rev != repo.Rev:
+			problems = append(problems, fmt.Sprintf("repo %s is pinned at rev %s but vendored at rev %s",
+				repo.Root, pinned.Rev, repo.Rev))
+		case pinned.URL != repo.URL || pinned.VCS != repo.VCS:
+			problems = append(problems, fmt.Sprintf("repo %s is pinned from %s (%s) but vendored from %s (%s)",
+				repo.Root, pinned.URL, pinned.VCS, repo.URL, repo.VCS))
+		case pinned.Source != repo.Source:
+			problems = append(problems, fmt.Sprintf("repo %s is pinned with source %s but vendored from source %s",
+				repo.Root, sourceName(pinned.Source), sourceName(repo.Source)))
+		}
+		hash, err := hashTree(filepath.Join(vendorDir, filepath.FromSlash(repo.Root)))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			problems = append(problems, fmt.Sprintf("vendored repo %s is missing", repo.Root))
+			continue
+		}
+		if hash != repo.Hash {
+			problems = append(problems, fmt.Sprintf("vendored repo %s has been modified", repo.Root))
+		}
+	}
+	for _, repo := range pinlist.Repos {
+		if _, ok := vendored[repo.Root]; !ok {
+			problems = append(problems, fmt.Sprintf("repo %s is pinned but not vendored", repo.Root))
+		}
+	}
+
+	// Anything else in the vendor directory was not put there by Vendor.
+	err = filepath.Walk(vendorDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(vendorDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if _, ok := vendored[rel]; ok {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && rel != vendorManifestName {
+			problems = append(problems, fmt.Sprintf("%s is not part of any vendored repo", rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s does not match %s:\n\t%s", vendorDir, pinlistName, strings.Join(problems, "\n\t"))
+	}
+	logEvent("vendor-ok", eventFields{"dir": vendorDir, "repos": len(manifest.Repos)},
+		"%s matches %s.\n", vendorDir, pinlistName)
+	return nil
+}
+
+// copyTree copies the directory tree at src to dst, skipping VCS metadata directories and any other repos
+// nested inside src. Symlinks are copied as symlinks.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			if ignoreDirs[info.Name()] || (path != src && isRepoDir(path)) {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(target, 0755)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		return copyFile(path, target, info.Mode().Perm())
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -1,21 +1,299 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"go/build"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
-type mismatchedDepsError struct {
-	error
+// A VerifyReport describes the ways in which a project's cache does not match its pinlist.
+type VerifyReport struct {
+	// Repos has the cache status of every pinned repo, in pinlist order.
+	Repos []RepoStatus
+	// Missing lists the pinned repos that are not in the cache.
+	Missing []PinnedRepo
+	// Unresolved lists the pinned repos that have a version but no rev yet (sync fills it in).
+	Unresolved []PinnedRepo
+	// Mismatched lists the pinned repos that are cached at a different rev than the pinned one.
+	Mismatched []Mismatch
+	// Dirty has the status of the pinned repos whose cached copies are dirty: they have uncommitted changes,
+	// untracked files, or ignored files that would be built.
+	Dirty []RepoStatus
+	// Orphaned lists the repos (by repo root) in the cache that are not in the pinlist.
+	Orphaned []string
+	// HashMismatched lists the pinned repos whose committed files in the cache don't match their pinned
+	// hashes.
+	HashMismatched []HashMismatch
+	// Linked lists the pinned repos that are linked to local directories (see link.go). Their cached copies
+	// are not checked, since builds don't use them.
+	Linked []RepoStatus
 }
 
-// Verify checks a project's cache directory against the dep list and returns an error if they do not match.
-func Verify(root string, pinlist *Pinlist) error {
+// A RepoStatus describes the state of a pinned repo in the cache.
+type RepoStatus struct {
+	Repo PinnedRepo
+	// Link is the directory the repo is linked to, if it is linked. The cache is not checked for linked repos.
+	Link string
+	// Cached is whether the repo is in the cache at all. If it isn't, the remaining fields are not set.
+	Cached    bool
+	CachedRev string
+	Dirty     bool
+	// DirtyFiles lists the files that make the cached copy dirty.
+	DirtyFiles []FileChange
+}
+
+// A HashMismatch is a pinned repo whose committed files in the cache don't match its pinned hash.
+type HashMismatch struct {
+	Repo PinnedRepo
+	// Hash is the hash of the files committed at the pinned rev in the cache.
+	Hash string
+	// Files lists the files that differ from the ones in the manifest (see Manifest). It is nil if the
+	// manifest has no files for the repo that match its pinned hash.
+	Files []FileChange
+}
+
+func (m HashMismatch) String() string {
+	msg := fmt.Sprintf("Dep repo %s does not match its pinned hash: the files committed at rev %s have changed "+
+		"since it was pinned (has the upstream history been rewritten, or the cached repo tampered with?)",
+		m.Repo.Root, m.Repo.Rev)
+	if m.Files == nil {
+		return msg + fmt.Sprintf(". (%s doesn't list the pinned files, so the changed files are unknown.)",
+			manifestName)
+	}
+	return msg + ":" + fileList(m.Files)
+}
+
+// fileList formats changes as an indented list, one per line (starting with a newline).
+func fileList(changes []FileChange) string {
+	var b strings.Builder
+	for _, change := range changes {
+		b.WriteString("\n\t")
+		b.WriteString(change.String())
+	}
+	return b.String()
+}
+
+// hashStampName is the name of a file in the VCS metadata directory of a cached repo that records the last
+// hash computed for it, as "<rev> <hash>". A rev's committed files can't change without something going
+// badly wrong, so unless told otherwise (see hashMode), hashRepo trusts the stamp rather than reading every
+// file again.
+const hashStampName = "glp-hash"
+
+// A hashMode says how hashRepo uses the hash stamp of a cached repo.
+type hashMode int
+
+const (
+	hashStamped  hashMode = iota // trust the stamp, and write a new one once the hash matches
+	hashReadOnly                 // trust the stamp, but never write one (for commands that modify nothing)
+	hashForce                    // ignore the stamp and recompute the hash, writing a new stamp if it matches
+)
+
+// hashRepo computes the hash of the files committed at the pinned rev of the pinned repo, which is cached at
+// dir (see VCSCmd.CommittedFiles and hashFiles). Changes in the working copy don't affect the hash; they are
+// found by the dirty check instead. If the repo has a pinned hash that doesn't match, hashRepo also returns a
+// description of the mismatch, naming the files that differ from the ones in manifest. Unless mode is
+// hashForce, if the hash stamp shows that the rev already matched its pinned hash, that hash is returned
+// without reading the files.
+func hashRepo(pinned *PinnedRepo, dir string, mode hashMode, manifest Manifest) (hash string,
+	mismatch *HashMismatch, err error) {
+
+	stamp := filepath.Join(dir, "."+pinned.VCS, hashStampName)
+	if mode != hashForce && pinned.Hash != "" {
+		if b, err := ioutil.ReadFile(stamp); err == nil && string(b) == pinned.Rev+" "+pinned.Hash+"\n" {
+			return pinned.Hash, nil, nil
+		}
+	}
+	files, err := pinned.RepoRoot().VCS.CommittedFiles(dir, pinned.Rev)
+	if err != nil {
+		return "", nil, err
+	}
+	hash = hashFiles(files)
+	if pinned.Hash != "" && pinned.Hash != hash {
+		mismatch := &HashMismatch{Repo: *pinned, Hash: hash}
+		if pinnedFiles := manifest.files(pinned); pinnedFiles != nil {
+			mismatch.Files = diffFiles(pinnedFiles, files)
+		}
+		return hash, mismatch, nil
+	}
+	if mode != hashReadOnly {
+		// If the stamp can't be written, the hash is just computed again next time.
+		ioutil.WriteFile(stamp, []byte(pinned.Rev+" "+hash+"\n"), 0666)
+	}
+	return hash, nil, nil
+}
+
+// A Mismatch is a pinned repo along with the rev that was actually found in the cache.
+type Mismatch struct {
+	Repo      PinnedRepo
+	CachedRev string
+}
+
+// Err returns an error describing the problems in r that prevent a build from using the pinned versions
+// (missing and mismatched repos), or nil if there are none.
+func (r *VerifyReport) Err() error {
+	var msgs []string
+	for _, repo := range r.Missing {
+		msgs = append(msgs, fmt.Sprintf("Repo %s not cached. Run 'glp sync'.", repo.Root))
+	}
+	for _, repo := range r.Unresolved {
+		msgs = append(msgs, fmt.Sprintf("Repo %s has version %s but no rev yet. Run 'glp sync'.",
+			repo.Root, repo.Version))
+	}
+	for _, m := range r.Mismatched {
+		msgs = append(msgs, fmt.Sprintf("Pinlist has version %s for %s, but found %s in cache.",
+			m.Repo.Rev, m.Repo.Root, m.CachedRev))
+	}
+	for _, m := range r.HashMismatched {
+		msgs = append(msgs, m.String())
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+}
+
+// CheckHashes recomputes the hashes of the pinned repos that are cached at their pinned revs and records the
+// ones that don't match their pinned hashes in r.HashMismatched. Unlike the hash check done by Verify, this
+// reads every committed file of every repo, even if its hash stamp says that it was already checked.
+func (r *VerifyReport) CheckHashes(root string) error {
+	return r.checkHashes(root, hashForce)
+}
+
+func (r *VerifyReport) checkHashes(root string, mode hashMode) error {
+	r.HashMismatched = nil
+	manifest, err := loadManifest(root)
+	if err != nil {
+		return err
+	}
+	for _, status := range r.Repos {
+		if !status.Cached || status.CachedRev != status.Repo.Rev || status.Repo.Hash == "" {
+			continue
+		}
+		dir := filepath.Join(config.cacheSrcDir(root), status.Repo.Root)
+		_, mismatch, err := hashRepo(&status.Repo, dir, mode, manifest)
+		if err != nil {
+			return err
+		}
+		if mismatch != nil {
+			r.HashMismatched = append(r.HashMismatched, *mismatch)
+		}
+	}
+	return nil
+}
+
+// ExactErr is like Err, but dirty repos are an error as well. It is for commands that use the contents of the
+// cached repos, which must then be exactly the pinned revisions.
+func (r *VerifyReport) ExactErr() error {
+	if err := r.Err(); err != nil {
+		return err
+	}
+	if len(r.Dirty) > 0 {
+		var msgs []string
+		for _, status := range r.Dirty {
+			msgs = append(msgs, fmt.Sprintf("Dep repo %s is dirty in the cache:%s",
+				status.Repo.Root, fileList(status.DirtyFiles)))
+		}
+		return errors.New(strings.Join(msgs, "\n"))
+	}
+	if len(r.Linked) > 0 {
+		return fmt.Errorf("dep repo %s is linked to %s (run 'glp unlink --all' to use the pinned revs)",
+			r.Linked[0].Repo.Root, r.Linked[0].Link)
+	}
+	return nil
+}
+
+// Log prints warnings to stderr about the problems in r that do not prevent a build (linked, dirty, and
+// orphaned repos). In JSON mode, it also reports the problems that are returned by Err.
+func (r *VerifyReport) Log() {
+	for _, status := range r.Linked {
+		warnEvent("repo-linked", eventFields{"repo": status.Repo.Root, "dir": status.Link, "rev": status.Repo.Rev},
+			"WARNING: dep repo %s is LINKED to %s; its pinned rev %s is NOT being used "+
+				"(run 'glp unlink %s' to undo)\n", status.Repo.Root, status.Link, status.Repo.Rev, status.Repo.Root)
+	}
+	for _, repo := range r.Missing {
+		logEvent("repo-missing", eventFields{"repo": repo.Root, "rev": repo.Rev}, "")
+	}
+	for _, repo := range r.Unresolved {
+		logEvent("repo-unresolved", eventFields{"repo": repo.Root, "version": repo.Version}, "")
+	}
+	for _, m := range r.Mismatched {
+		logEvent("rev-mismatch", eventFields{"repo": m.Repo.Root, "rev": m.Repo.Rev, "cached_rev": m.CachedRev}, "")
+	}
+	for _, m := range r.HashMismatched {
+		logEvent("hash-mismatch",
+			eventFields{"repo": m.Repo.Root, "hash": m.Repo.Hash, "cached_hash": m.Hash, "files": m.Files}, "")
+	}
+	for _, status := range r.Dirty {
+		warnEvent("repo-dirty", eventFields{"repo": status.Repo.Root, "files": status.DirtyFiles},
+			"Warning: found dirty cached repo %s:%s\n", status.Repo.Root, fileList(status.DirtyFiles))
+	}
+	for _, repo := range r.Orphaned {
+		warnEvent("repo-orphaned", eventFields{"repo": repo},
+			"Warning: cached repo %s is not in the pinlist (run 'glp prune' to remove it)\n", repo)
+	}
+}
+
+func runVerify(root string, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	strict := fs.Bool("strict", false, "Recompute the hash of each repo instead of trusting its hash "+
+		"stamp, and treat dirty repos as errors")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments to verify: %v", args)
+	}
+	pinlist, err := loadRequiredPinlist(root)
+	if err != nil {
+		return err
+	}
+	report, err := Verify(root, pinlist)
+	if err != nil {
+		return err
+	}
+	if *strict {
+		if err := report.CheckHashes(root); err != nil {
+			return err
+		}
+	}
+	report.Log()
+	if *strict {
+		err = report.ExactErr()
+	} else {
+		err = report.Err()
+	}
+	if err != nil {
+		return err
+	}
+	logEvent("verified", eventFields{"repos": len(report.Repos), "strict": *strict},
+		"The cache matches %s (%d repos).\n", pinlistName, len(report.Repos))
+	return nil
+}
+
+// Verify checks a project's cache directory against the dep list and reports any differences, including hash
+// mismatches (trusting the hash stamps; see hashRepo). It does not modify the cache, apart from writing hash
+// stamps; an error is only returned if verification could not be performed.
+func Verify(root string, pinlist *Pinlist) (*VerifyReport, error) {
+	report, err := verifyCache(root, pinlist)
+	if err != nil {
+		return nil, err
+	}
+	if err := report.checkHashes(root, hashStamped); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// verifyCache is Verify without the hash check.
+func verifyCache(root string, pinlist *Pinlist) (*VerifyReport, error) {
 	// Find all the repos containing Go packages in the cache.
-	cache := filepath.Join(root, projectDirName, cacheDirName, "src")
+	cache := config.cacheSrcDir(root)
 	context := new(build.Context)
 	*context = build.Default
 	context.GOPATH = cache
@@ -33,64 +311,74 @@ func Verify(root string, pinlist *Pinlist) error {
 			if strings.HasPrefix(err.Error(), "found packages ") {
 				continue
 			}
-			return err
+			return nil, err
 		}
 		importPath, err := filepath.Rel(cache, path)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		repoRoot, err := RepoRootForImportPath(importPath, false)
-		if err != nil {
-			return err
+		if pinned := pinlist.FindPackage(importPath); pinned != nil {
+			cachedRepos.Add(pinned.Root)
+			continue
 		}
-		cachedRepos.Add(repoRoot.Root)
-	}
-
-	// Verify that the package exists with the correct version for each package in the pinlist. Remove from the
-	// list of cached repos as we go.
-	for _, dep := range pinlist.Deps {
-		if err := verify(root, dep); err != nil {
-			return err
+		if repoRoot, _, ok := findCachedRepo(cache, importPath); ok {
+			cachedRepos.Add(repoRoot)
+		} else {
+			// Not part of any repo (perhaps copied in by hand).
+			cachedRepos.Add(importPath)
 		}
-		repoRoot, err := RepoRootForImportPath(dep.Name, false)
-		if err != nil {
-			return err
-		}
-		cachedRepos.Remove(repoRoot.Root)
 	}
 
-	// If there are any repos left in cachedRepos, they are not used by any packages in the pinlist. We need to
-	// remove these to avoid polluting the namespace and allowing untracked dependencies in the build.
-	for _, repo := range cachedRepos {
-		fmt.Printf("Removing cached repo not in the pinlist: %s\n", repo)
-		if err := os.RemoveAll(filepath.Join(cache, repo)); err != nil {
-			return err
+	// Check that each repo in the pinlist exists with the correct version (unless it is linked). Remove from
+	// the list of cached repos as we go.
+	links, err := findLinks(root)
+	if err != nil {
+		return nil, err
+	}
+	report := new(VerifyReport)
+	for _, repo := range pinlist.Repos {
+		if link, ok := links[repo.Root]; ok {
+			status := RepoStatus{Repo: repo, Link: link}
+			report.Repos = append(report.Repos, status)
+			report.Linked = append(report.Linked, status)
+			cachedRepos.Remove(repo.Root)
+			continue
+		}
+		if err := verify(root, repo, report); err != nil {
+			return nil, err
 		}
+		cachedRepos.Remove(repo.Root)
 	}
 
-	return nil
+	// If there are any repos left in cachedRepos, they are not used by any packages in the pinlist.
+	report.Orphaned = cachedRepos
+	return report, nil
 }
 
-func verify(root string, dep Dep) error {
-	repo, err := RepoRootForImportPath(dep.Name, false)
-	if err != nil {
-		return err
-	}
-	dir := filepath.Join(root, projectDirName, cacheDirName, "src", repo.Root)
-	// Check if the directory exists first just to provide a friendlier warning.
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		return fmt.Errorf("Repo %s (for dependency %s) not cached. Run 'glp sync'.", repo.Repo, dep.Name)
+// verify checks a single pinned repo against the cache, recording its status and any problems in report.
+func verify(root string, pinned PinnedRepo, report *VerifyReport) error {
+	dir := filepath.Join(config.cacheSrcDir(root), pinned.Root)
+	if _, err := os.Stat(dir); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		report.Repos = append(report.Repos, RepoStatus{Repo: pinned})
+		report.Missing = append(report.Missing, pinned)
+		return nil
 	}
-	rev, dirty, err := repo.VCS.GetRev(dir)
+	rev, dirty, err := pinned.RepoRoot().VCS.GetRev(dir)
 	if err != nil {
 		return err
 	}
-	if rev != dep.Rev {
-		err := fmt.Errorf("Pinlist has version %s for %s, but found %s in cache.", dep.Rev, dep.Name, rev)
-		return mismatchedDepsError{err}
+	status := RepoStatus{Repo: pinned, Cached: true, CachedRev: rev, Dirty: len(dirty) > 0, DirtyFiles: dirty}
+	report.Repos = append(report.Repos, status)
+	if pinned.Rev == "" {
+		report.Unresolved = append(report.Unresolved, pinned)
+	} else if rev != pinned.Rev {
+		report.Mismatched = append(report.Mismatched, Mismatch{Repo: pinned, CachedRev: rev})
 	}
-	if dirty {
-		fmt.Fprintf(os.Stderr, "Warning: found dirty repo for dependency %s\n", dep.Name)
+	if status.Dirty {
+		report.Dirty = append(report.Dirty, status)
 	}
 	return nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"flag"
+)
+
+func runWhy(root, gopath string, args []string) error {
+	fs := flag.NewFlagSet("why", flag.ContinueOnError)
+	all := fs.Bool("all", false, "Show every import chain rather than only the shortest ones")
+	withDepTests := fs.Bool("with-dep-tests", false, "Follow the test imports of dependencies")
+	buildOpts := new(BuildOptions)
+	addBuildFlags(fs, buildOpts)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("usage: glp why [--all] [--with-dep-tests] [--platforms LIST] [--tags LIST] IMPORTPATH")
+	}
+	return Why(root, gopath, args[0], *all, *withDepTests, buildOpts)
+}
+
+// Why explains why the project located at root depends on target (a package, or a directory such as a repo
+// root containing packages) by printing the shortest chains of imports leading from the project packages to
+// target, or every such chain if all is true. The test imports of dependencies are only followed if
+// withDepTests is true. Imports are found in every build configuration selected by buildOpts.
+func Why(root, gopath, target string, all, withDepTests bool, buildOpts *BuildOptions) error {
+	matrix, err := newBuildMatrix(gopath, buildOpts)
+	if err != nil {
+		return err
+	}
+	graph, err := buildImportGraph(matrix, root, withDepTests)
+	if err != nil {
+		return err
+	}
+
+	var chains []importChain
+	if all {
+		chains = graph.AllChains(target)
+	} else {
+		chains = graph.ShortestChains(target)
+	}
+	if len(chains) == 0 {
+		logEvent("not-imported", eventFields{"target": target}, "%s is not imported by the project.\n", target)
+		return nil
+	}
+	testOnly := true
+	for _, chain := range chains {
+		note := ""
+		if chain.TestOnly() {
+			note = " (test only)"
+		} else {
+			testOnly = false
+		}
+		kinds := make([]string, len(chain.Kinds))
+		for i, kind := range chain.Kinds {
+			kinds[i] = kind.String()
+		}
+		logEvent("import-chain", eventFields{
+			"target":    target,
+			"packages":  chain.Packages,
+			"kinds":     kinds,
+			"test_only": chain.TestOnly(),
+		}, "%s%s\n", chain, note)
+	}
+	if testOnly {
+		textf("%s is only imported through tests.\n", target)
+	}
+	return nil
+}